@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// clfTimeFormat is the time format used in NCSA Common Log Format lines.
+const clfTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// AccessLog writes a line for each request handled by next to wr, either in
+// the NCSA Common Log Format ("common") or in the Combined Log Format
+// ("combined"), which adds the referer and user agent.
+func AccessLog(next http.Handler, format string, wr io.Writer) (http.Handler, error) {
+	if format != "common" && format != "combined" {
+		return nil, fmt.Errorf("unknown log_format %q", format)
+	}
+
+	logger := log.New(wr, "", 0)
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		rec, wrapped := newResponseRecorder(rw)
+
+		skip := false
+		req = req.WithContext(context.WithValue(req.Context(), skipLogKey{}, &skip))
+		next.ServeHTTP(wrapped, req)
+
+		if skip {
+			return
+		}
+
+		line := formatCommonLog(req, start, rec.Status(), rec.Bytes())
+		if format == "combined" {
+			line += fmt.Sprintf(" %q %q", dashIfEmpty(req.Referer()), dashIfEmpty(req.UserAgent()))
+		}
+		logger.Print(line)
+	}), nil
+}
+
+type skipLogKey struct{}
+
+// skipAccessLog marks the request so that AccessLog does not write a line
+// for it.
+func skipAccessLog(req *http.Request) {
+	if skip, ok := req.Context().Value(skipLogKey{}).(*bool); ok {
+		*skip = true
+	}
+}
+
+func dashIfEmpty(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// logURI returns the request URI without the credentials of signed URLs.
+func logURI(uri string) string {
+	i := strings.IndexByte(uri, '?')
+	if i < 0 {
+		return uri
+	}
+
+	query := removeQueryParams(uri[i+1:], signedURLParams)
+	if query == "" {
+		return uri[:i]
+	}
+
+	return uri[:i+1] + query
+}
+
+// formatCommonLog returns the Common Log Format line for the request.
+func formatCommonLog(req *http.Request, start time.Time, status int, bytes int64) string {
+	host := clientIP(req)
+
+	user := "-"
+	if name, _, ok := req.BasicAuth(); ok && name != "" {
+		user = name
+	}
+
+	size := "-"
+	if bytes > 0 {
+		size = strconv.FormatInt(bytes, 10)
+	}
+
+	request := fmt.Sprintf("%s %s %s", req.Method, logURI(req.RequestURI), req.Proto)
+
+	return fmt.Sprintf("%s - %s [%s] %q %d %s",
+		host, user, start.Format(clfTimeFormat), request, status, size)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestLogURI(t *testing.T) {
+	var tests = []struct {
+		uri  string
+		want string
+	}{
+		{"/debian/pool/x.deb", "/debian/pool/x.deb"},
+		{"/debian/pool/x.deb?", "/debian/pool/x.deb"},
+		{"/private/x.rpm?expires=1700000000&signature=abcdef", "/private/x.rpm"},
+		{"/private/x.rpm?b=2&expires=1700000000&a=1&signature=abcdef", "/private/x.rpm?b=2&a=1"},
+		{"/private/x.rpm?signature=abcdef&c=%2F", "/private/x.rpm?c=%2F"},
+		{"/private/x.rpm?%73ignature=abcdef&x", "/private/x.rpm?x"},
+		{"/private/x.rpm?signatures=1&expires_at=2", "/private/x.rpm?signatures=1&expires_at=2"},
+		{"http://example.com/x.deb?signature=abcdef&v=1", "http://example.com/x.deb?v=1"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.uri, func(t *testing.T) {
+			got := logURI(test.uri)
+			if got != test.want {
+				t.Fatalf("wrong URI, want %q, got %q", test.want, got)
+			}
+		})
+	}
+}
+
+func TestFormatCommonLog(t *testing.T) {
+	start := time.Date(2019, 7, 1, 12, 30, 45, 0, time.FixedZone("", 2*3600))
+
+	var tests = []struct {
+		name   string
+		req    *http.Request
+		status int
+		bytes  int64
+		want   string
+	}{
+		{
+			name:   "get",
+			req:    httptest.NewRequest(http.MethodGet, "/debian/pool/x.deb", nil),
+			status: http.StatusOK,
+			bytes:  1234,
+			want:   `192.0.2.1 - - [01/Jul/2019:12:30:45 +0200] "GET /debian/pool/x.deb HTTP/1.1" 200 1234`,
+		},
+		{
+			name:   "empty",
+			req:    httptest.NewRequest(http.MethodHead, "/debian/pool/x.deb", nil),
+			status: http.StatusNotModified,
+			want:   `192.0.2.1 - - [01/Jul/2019:12:30:45 +0200] "HEAD /debian/pool/x.deb HTTP/1.1" 304 -`,
+		},
+		{
+			name:   "signed",
+			req:    httptest.NewRequest(http.MethodGet, "/private/x.rpm?expires=1700000000&signature=abcdef", nil),
+			status: http.StatusOK,
+			bytes:  10,
+			want:   `192.0.2.1 - - [01/Jul/2019:12:30:45 +0200] "GET /private/x.rpm HTTP/1.1" 200 10`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := formatCommonLog(test.req, start, test.status, test.bytes)
+			if got != test.want {
+				t.Fatalf("wrong line\nwant: %s\n got: %s", test.want, got)
+			}
+		})
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/quiet" {
+			skipAccessLog(req)
+		}
+		rw.WriteHeader(http.StatusCreated)
+		_, _ = rw.Write([]byte("hello"))
+	})
+
+	var tests = []struct {
+		format string
+		want   string
+	}{
+		{"common", `^192\.0\.2\.1 - alice \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\] "GET /private/x\.rpm\?v=1 HTTP/1\.1" 201 5\n$`},
+		{"combined", `^192\.0\.2\.1 - alice \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\] "GET /private/x\.rpm\?v=1 HTTP/1\.1" 201 5 "http://example\.com/\\"x\\"" "APT-HTTP/1\.3 \(1\.8\.2\)"\n$`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.format, func(t *testing.T) {
+			var buf bytes.Buffer
+			handler, err := AccessLog(next, test.format, &buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/private/x.rpm?v=1&expires=1700000000&signature=abcdef", nil)
+			req.SetBasicAuth("alice", "secret")
+			req.Header.Set("Referer", `http://example.com/"x"`)
+			req.Header.Set("User-Agent", "APT-HTTP/1.3 (1.8.2)")
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			if !regexp.MustCompile(test.want).MatchString(buf.String()) {
+				t.Fatalf("wrong line %q", buf.String())
+			}
+
+			buf.Reset()
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/quiet", nil))
+			if buf.Len() != 0 {
+				t.Fatalf("line was written for skipped request: %q", buf.String())
+			}
+		})
+	}
+
+	_, err := AccessLog(next, "json", &bytes.Buffer{})
+	if err == nil {
+		t.Fatal("unknown format was accepted")
+	}
+}
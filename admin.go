@@ -0,0 +1,27 @@
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+)
+
+// registerPprof installs the handlers for runtime profiles below
+// /debug/pprof/ on mux.
+func registerPprof(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+}
+
+// AdminHandler returns the handler for the admin listener, all requests must
+// carry the admin token as a bearer token.
+func AdminHandler(mux *http.ServeMux, token string, shared *Shared) (http.Handler, error) {
+	auth, err := NewAuthenticator(Auth{Scheme: "bearer", Tokens: []string{token}})
+	if err != nil {
+		return nil, err
+	}
+
+	return RequireAuth(mux, auth, shared), nil
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// authRealm is sent in the WWW-Authenticate header of 401 responses.
+const authRealm = "distriproxy"
+
+// Authenticator checks the credentials sent by clients. The scheme is one of:
+//
+//   - "bearer": the header "Authorization: Bearer <token>" must contain one of
+//     the configured tokens
+//   - "basic": HTTP Basic authentication with the configured users
+//   - "signed": the query string must contain "expires" (a Unix timestamp in
+//     the future) and "signature", the hex encoded HMAC-SHA256 of the string
+//     "<path>\n<expires>" using the configured secret, where path is the
+//     request path (e.g. /debian/pool/main/x.deb)
+type Authenticator struct {
+	scheme string
+	tokens []string
+	users  map[string]string
+	secret []byte
+}
+
+// NewAuthenticator returns an authenticator for the config.
+func NewAuthenticator(cfg Auth) (*Authenticator, error) {
+	a := &Authenticator{scheme: cfg.Scheme}
+
+	switch cfg.Scheme {
+	case "bearer":
+		if len(cfg.Tokens) == 0 {
+			return nil, errors.New("auth scheme bearer needs tokens")
+		}
+		a.tokens = cfg.Tokens
+	case "basic":
+		if len(cfg.Users) == 0 {
+			return nil, errors.New("auth scheme basic needs users")
+		}
+
+		a.users = make(map[string]string, len(cfg.Users))
+		for _, user := range cfg.Users {
+			data := strings.SplitN(user, ":", 2)
+			if len(data) != 2 || data[0] == "" {
+				return nil, fmt.Errorf("invalid user %q, expected name:password", user)
+			}
+			a.users[data[0]] = data[1]
+		}
+	case "signed":
+		if cfg.Secret == nil || *cfg.Secret == "" {
+			return nil, errors.New("auth scheme signed needs a secret")
+		}
+		a.secret = []byte(*cfg.Secret)
+	default:
+		return nil, fmt.Errorf("unknown auth scheme %q", cfg.Scheme)
+	}
+
+	return a, nil
+}
+
+// equal compares two strings in constant time.
+func equal(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// Sign returns the signature for path which is valid until expires.
+func (a *Authenticator) Sign(path string, expires time.Time) string {
+	mac := hmac.New(sha256.New, a.secret)
+	fmt.Fprintf(mac, "%s\n%d", path, expires.Unix())
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// parseBasicAuth returns the name and password from the value of an
+// Authorization or Proxy-Authorization header for HTTP Basic authentication.
+func parseBasicAuth(header string) (name, password string, ok bool) {
+	const prefix = "Basic "
+	if len(header) < len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", "", false
+	}
+
+	buf, err := base64.StdEncoding.DecodeString(header[len(prefix):])
+	if err != nil {
+		return "", "", false
+	}
+
+	data := strings.SplitN(string(buf), ":", 2)
+	if len(data) != 2 {
+		return "", "", false
+	}
+
+	return data[0], data[1], true
+}
+
+// verify returns an error if the credentials are not valid. header is the
+// value of the Authorization (or Proxy-Authorization) header, query and path
+// are used for signed URLs.
+func (a *Authenticator) verify(header string, query url.Values, path string) error {
+	switch a.scheme {
+	case "bearer":
+		if !strings.HasPrefix(header, "Bearer ") {
+			return errors.New("no bearer token")
+		}
+
+		token := strings.TrimPrefix(header, "Bearer ")
+		valid := false
+		for _, t := range a.tokens {
+			if equal(t, token) {
+				valid = true
+			}
+		}
+
+		if !valid {
+			return errors.New("invalid bearer token")
+		}
+	case "basic":
+		name, password, ok := parseBasicAuth(header)
+		if !ok {
+			return errors.New("no basic auth credentials")
+		}
+
+		expected, ok := a.users[name]
+		if !ok || !equal(expected, password) {
+			return fmt.Errorf("invalid password for user %q", name)
+		}
+	case "signed":
+		ts, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+		if err != nil {
+			return errors.New("no valid expires parameter")
+		}
+
+		expires := time.Unix(ts, 0)
+		if !equal(a.Sign(path, expires), query.Get("signature")) {
+			return errors.New("invalid signature")
+		}
+
+		if time.Now().After(expires) {
+			return fmt.Errorf("signature expired at %v", expires)
+		}
+	}
+
+	return nil
+}
+
+// check returns an error if the request does not carry valid credentials.
+func (a *Authenticator) check(req *http.Request) error {
+	return a.verify(req.Header.Get("Authorization"), req.URL.Query(), req.URL.Path)
+}
+
+// checkProxy returns an error if the proxy request does not carry valid
+// credentials in the Proxy-Authorization header. Signed URLs are checked
+// against path, which is the local path for requests routed to a configured
+// path and the complete URL (without the query string) otherwise.
+func (a *Authenticator) checkProxy(req *http.Request, path string) error {
+	return a.verify(req.Header.Get("Proxy-Authorization"), req.URL.Query(), path)
+}
+
+// challenge returns the value for the WWW-Authenticate or Proxy-Authenticate
+// header, it is empty for signed URLs.
+func (a *Authenticator) challenge() string {
+	switch a.scheme {
+	case "bearer":
+		return fmt.Sprintf("Bearer realm=%q", authRealm)
+	case "basic":
+		return fmt.Sprintf("Basic realm=%q", authRealm)
+	}
+	return ""
+}
+
+// signedURLParams are the query parameters which carry the credentials of
+// signed URLs.
+var signedURLParams = []string{"expires", "signature"}
+
+// removeQueryParams returns rawQuery without the parameters in names, the
+// other parameters are kept as they are, in the same order and with the same
+// escaping.
+func removeQueryParams(rawQuery string, names []string) string {
+	if rawQuery == "" {
+		return ""
+	}
+
+	parts := strings.Split(rawQuery, "&")
+	kept := parts[:0]
+	for _, part := range parts {
+		key := part
+		if i := strings.IndexByte(key, '='); i >= 0 {
+			key = key[:i]
+		}
+		if k, err := url.QueryUnescape(key); err == nil {
+			key = k
+		}
+
+		remove := false
+		for _, name := range names {
+			if key == name {
+				remove = true
+				break
+			}
+		}
+
+		if !remove {
+			kept = append(kept, part)
+		}
+	}
+
+	return strings.Join(kept, "&")
+}
+
+// withoutCredentials returns a copy of req without the credentials, so that
+// they are not passed on to the upstream server: the header field (either
+// Authorization or Proxy-Authorization) and, for signed URLs, the parameters
+// expires and signature in the query string.
+func (a *Authenticator) withoutCredentials(req *http.Request, field string) *http.Request {
+	_, hasHeader := req.Header[field]
+	signed := a.scheme == "signed" && req.URL.RawQuery != ""
+	if !hasHeader && !signed {
+		return req
+	}
+
+	r := new(http.Request)
+	*r = *req
+
+	if hasHeader {
+		r.Header = make(http.Header, len(req.Header))
+		for name, values := range req.Header {
+			if name == field {
+				continue
+			}
+			r.Header[name] = values
+		}
+	}
+
+	if signed {
+		u := *req.URL
+		u.RawQuery = removeQueryParams(u.RawQuery, signedURLParams)
+		r.URL = &u
+	}
+
+	return r
+}
+
+// RequireAuth passes requests with valid credentials to next, other requests
+// are answered with 401.
+func RequireAuth(next http.Handler, auth *Authenticator, shared *Shared) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		err := auth.check(req)
+		if err != nil {
+			if challenge := auth.challenge(); challenge != "" {
+				rw.Header().Set("WWW-Authenticate", challenge)
+			}
+
+			shared.writeError(rw, req, "", errUnauthorized("%v %v %v reject request: %v", clientIP(req), req.Method, req.URL.Path, err))
+			return
+		}
+
+		next.ServeHTTP(rw, auth.withoutCredentials(req, "Authorization"))
+	})
+}
+
+// authorizeProxy checks the credentials of the proxy request req for path
+// (see checkProxy). Requests without valid credentials are answered with 407
+// and false is returned. Otherwise, the request without the credentials is
+// returned.
+func (a *Authenticator) authorizeProxy(rw http.ResponseWriter, req *http.Request, path string, shared *Shared) (*http.Request, bool) {
+	err := a.checkProxy(req, path)
+	if err != nil {
+		if challenge := a.challenge(); challenge != "" {
+			rw.Header().Set("Proxy-Authenticate", challenge)
+		}
+
+		shared.writeError(rw, req, "", errProxyAuthRequired("%v reject proxy request for %v: %v", clientIP(req), req.URL, err))
+		return nil, false
+	}
+
+	return a.withoutCredentials(req, "Proxy-Authorization"), true
+}
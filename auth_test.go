@@ -0,0 +1,360 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func basicAuth(name, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(name+":"+password))
+}
+
+func TestNewAuthenticator(t *testing.T) {
+	secret := "foobar"
+	empty := ""
+
+	var tests = []struct {
+		name string
+		cfg  Auth
+		ok   bool
+	}{
+		{"bearer", Auth{Scheme: "bearer", Tokens: []string{"x"}}, true},
+		{"bearer-no-tokens", Auth{Scheme: "bearer"}, false},
+		{"basic", Auth{Scheme: "basic", Users: []string{"alice:secret"}}, true},
+		{"basic-no-users", Auth{Scheme: "basic"}, false},
+		{"basic-no-password", Auth{Scheme: "basic", Users: []string{"alice"}}, false},
+		{"basic-no-name", Auth{Scheme: "basic", Users: []string{":secret"}}, false},
+		{"signed", Auth{Scheme: "signed", Secret: &secret}, true},
+		{"signed-no-secret", Auth{Scheme: "signed"}, false},
+		{"signed-empty-secret", Auth{Scheme: "signed", Secret: &empty}, false},
+		{"unknown", Auth{Scheme: "digest"}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := NewAuthenticator(test.cfg)
+			if test.ok && err != nil {
+				t.Fatal(err)
+			}
+
+			if !test.ok && err == nil {
+				t.Fatal("expected error not found")
+			}
+		})
+	}
+}
+
+func TestAuthenticatorVerify(t *testing.T) {
+	secret := "foobar"
+	bearer, err := NewAuthenticator(Auth{Scheme: "bearer", Tokens: []string{"token1", "token2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	basic, err := NewAuthenticator(Auth{Scheme: "basic", Users: []string{"alice:secret", "bob:pass:word"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signed, err := NewAuthenticator(Auth{Scheme: "signed", Secret: &secret})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const path = "/debian/pool/main/x.deb"
+	valid := time.Now().Add(time.Hour)
+	expired := time.Now().Add(-time.Minute)
+
+	query := func(path string, expires time.Time, sign time.Time) url.Values {
+		return url.Values{
+			"expires":   []string{strconv.FormatInt(expires.Unix(), 10)},
+			"signature": []string{signed.Sign(path, sign)},
+		}
+	}
+
+	var tests = []struct {
+		name   string
+		auth   *Authenticator
+		header string
+		query  url.Values
+		ok     bool
+	}{
+		{"bearer", bearer, "Bearer token1", nil, true},
+		{"bearer-second", bearer, "Bearer token2", nil, true},
+		{"bearer-wrong", bearer, "Bearer token3", nil, false},
+		{"bearer-missing", bearer, "", nil, false},
+		{"bearer-basic", bearer, basicAuth("alice", "secret"), nil, false},
+
+		{"basic", basic, basicAuth("alice", "secret"), nil, true},
+		{"basic-colon", basic, basicAuth("bob", "pass:word"), nil, true},
+		{"basic-lowercase", basic, "basic " + base64.StdEncoding.EncodeToString([]byte("alice:secret")), nil, true},
+		{"basic-wrong-password", basic, basicAuth("alice", "wrong"), nil, false},
+		{"basic-unknown-user", basic, basicAuth("carol", "secret"), nil, false},
+		{"basic-invalid-base64", basic, "Basic !!!", nil, false},
+		{"basic-missing", basic, "", nil, false},
+
+		{"signed", signed, "", query(path, valid, valid), true},
+		{"signed-expired", signed, "", query(path, expired, expired), false},
+		{"signed-extended", signed, "", query(path, valid, expired), false},
+		{"signed-other-path", signed, "", query("/debian/pool/main/y.deb", valid, valid), false},
+		{"signed-no-signature", signed, "", url.Values{"expires": []string{strconv.FormatInt(valid.Unix(), 10)}}, false},
+		{"signed-no-expires", signed, "", url.Values{"signature": []string{signed.Sign(path, valid)}}, false},
+		{"signed-missing", signed, "", nil, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.auth.verify(test.header, test.query, path)
+			if test.ok && err != nil {
+				t.Fatal(err)
+			}
+
+			if !test.ok && err == nil {
+				t.Fatal("expected error not found")
+			}
+		})
+	}
+}
+
+func TestSignOtherSecret(t *testing.T) {
+	secret1, secret2 := "foo", "bar"
+	a1, err := NewAuthenticator(Auth{Scheme: "signed", Secret: &secret1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a2, err := NewAuthenticator(Auth{Scheme: "signed", Secret: &secret2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expires := time.Now().Add(time.Hour)
+	query := url.Values{
+		"expires":   []string{strconv.FormatInt(expires.Unix(), 10)},
+		"signature": []string{a1.Sign("/x", expires)},
+	}
+
+	if a1.verify("", query, "/x") != nil {
+		t.Fatal("signature not accepted with the same secret")
+	}
+
+	if a2.verify("", query, "/x") == nil {
+		t.Fatal("signature accepted with another secret")
+	}
+}
+
+// echoHeaders returns a server which answers with the credentials it has
+// received.
+func echoHeaders() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(rw, "authorization=%q proxy-authorization=%q query=%q",
+			req.Header.Get("Authorization"), req.Header.Get("Proxy-Authorization"), req.URL.RawQuery)
+	}))
+}
+
+func TestRequireAuth(t *testing.T) {
+	secret := "foobar"
+	basic, err := NewAuthenticator(Auth{Scheme: "basic", Users: []string{"alice:secret"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signed, err := NewAuthenticator(Auth{Scheme: "signed", Secret: &secret})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upstream := echoHeaders()
+	defer upstream.Close()
+
+	expires := time.Now().Add(time.Hour)
+	signedQuery := fmt.Sprintf("expires=%d&signature=%s", expires.Unix(), signed.Sign("/debian/x.deb", expires))
+
+	var tests = []struct {
+		name         string
+		auth         *Authenticator
+		header       string
+		query        string
+		status       int
+		authenticate string
+		forwarded    string
+	}{
+		{"basic", basic, basicAuth("alice", "secret"), "", http.StatusOK, "", ""},
+		{"basic-query", basic, basicAuth("alice", "secret"), "b=2&a=1&signature=x", http.StatusOK, "", "b=2&a=1&signature=x"},
+		{"basic-wrong", basic, basicAuth("alice", "wrong"), "", http.StatusUnauthorized, `Basic realm="distriproxy"`, ""},
+		{"basic-missing", basic, "", "", http.StatusUnauthorized, `Basic realm="distriproxy"`, ""},
+		{"signed", signed, "", signedQuery, http.StatusOK, "", ""},
+		{"signed-other-params", signed, "", signedQuery + "&foo=bar", http.StatusOK, "", "foo=bar"},
+		{"signed-order", signed, "", "b=2&" + signedQuery + "&a=1&c=%2F&d=x+y&e", http.StatusOK, "", "b=2&a=1&c=%2F&d=x+y&e"},
+		{"signed-missing", signed, "", "", http.StatusUnauthorized, "", ""},
+	}
+
+	forwardQuery := true
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			proxy, err := NewProxy(Path{Path: "/debian", URL: upstream.URL, ForwardQuery: &forwardQuery}, nil, &Shared{LogLevel: LogError})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			srv := httptest.NewServer(RequireAuth(proxy, test.auth, &Shared{LogLevel: LogError}))
+			defer srv.Close()
+
+			req, err := http.NewRequest(http.MethodGet, srv.URL+"/debian/x.deb?"+test.query, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if test.header != "" {
+				req.Header.Set("Authorization", test.header)
+			}
+
+			res, body := do(t, http.DefaultClient, req)
+			if res.StatusCode != test.status {
+				t.Fatalf("wrong status, want %v, got %v", test.status, res.StatusCode)
+			}
+
+			if res.Header.Get("WWW-Authenticate") != test.authenticate {
+				t.Fatalf("wrong WWW-Authenticate header, want %q, got %q", test.authenticate, res.Header.Get("WWW-Authenticate"))
+			}
+
+			if res.StatusCode != http.StatusOK {
+				return
+			}
+
+			if !strings.HasPrefix(body, `authorization="" `) {
+				t.Fatalf("credentials passed on to the upstream server: %v", body)
+			}
+
+			if !strings.HasSuffix(body, fmt.Sprintf(" query=%q", test.forwarded)) {
+				t.Fatalf("wrong query passed on to the upstream server, want %q: %v", test.forwarded, body)
+			}
+		})
+	}
+}
+
+func TestForwardProxyAuth(t *testing.T) {
+	auth, err := NewAuthenticator(Auth{Scheme: "basic", Users: []string{"alice:secret"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upstream := echoHeaders()
+	defer upstream.Close()
+
+	shared := &Shared{LogLevel: LogError}
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	forward := NewForwardProxy([]string{u.Hostname()}, http.DefaultClient, auth, shared)
+	for _, path := range []struct {
+		path        string
+		requireAuth bool
+	}{
+		{"/debian", true},
+		{"/public", false},
+	} {
+		proxy, err := NewProxy(Path{Path: path.path, URL: upstream.URL + path.path}, nil, shared)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = forward.AddRoute(upstream.URL+path.path, path.path, proxy, path.requireAuth)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	srv := httptest.NewServer(RejectProxyRequests(http.NotFoundHandler(), forward, defaultAllowedMethods, shared))
+	defer srv.Close()
+
+	proxyURL, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	var tests = []struct {
+		name   string
+		path   string
+		field  string
+		value  string
+		status int
+	}{
+		{"route", "/debian/x.deb", "Proxy-Authorization", basicAuth("alice", "secret"), http.StatusOK},
+		{"route-wrong", "/debian/x.deb", "Proxy-Authorization", basicAuth("alice", "wrong"), http.StatusProxyAuthRequired},
+		{"route-missing", "/debian/x.deb", "", "", http.StatusProxyAuthRequired},
+		{"route-authorization", "/debian/x.deb", "Authorization", basicAuth("alice", "secret"), http.StatusProxyAuthRequired},
+		{"route-public", "/public/x.deb", "", "", http.StatusOK},
+		{"host", "/other/x.deb", "Proxy-Authorization", basicAuth("alice", "secret"), http.StatusOK},
+		{"host-missing", "/other/x.deb", "", "", http.StatusProxyAuthRequired},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, upstream.URL+test.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if test.field != "" {
+				req.Header.Set(test.field, test.value)
+			}
+
+			res, body := do(t, client, req)
+			if res.StatusCode != test.status {
+				t.Fatalf("wrong status, want %v, got %v", test.status, res.StatusCode)
+			}
+
+			if res.StatusCode == http.StatusProxyAuthRequired {
+				want := `Basic realm="distriproxy"`
+				if res.Header.Get("Proxy-Authenticate") != want {
+					t.Fatalf("wrong Proxy-Authenticate header, want %q, got %q", want, res.Header.Get("Proxy-Authenticate"))
+				}
+				return
+			}
+
+			if !strings.Contains(body, `proxy-authorization="" `) {
+				t.Fatalf("credentials passed on to the upstream server: %v", body)
+			}
+		})
+	}
+}
+
+func TestRemoveQueryParams(t *testing.T) {
+	var tests = []struct {
+		query string
+		want  string
+	}{
+		{"", ""},
+		{"expires=1&signature=x", ""},
+		{"signature=x&expires=1&v=2", "v=2"},
+		{"b=2&expires=1&a=1&signature=x", "b=2&a=1"},
+		{"c=%2F&d=x+y&e&signature=x", "c=%2F&d=x+y&e"},
+		{"signature&expires=", ""},
+		{"%73ignature=x&%65xpires=1&a=1", "a=1"},
+		{"signatures=1&expires_at=2&Signature=3", "signatures=1&expires_at=2&Signature=3"},
+		{"a=1&a=2&signature=x&a=3", "a=1&a=2&a=3"},
+		{"a=1&&b=2", "a=1&&b=2"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.query, func(t *testing.T) {
+			got := removeQueryParams(test.query, signedURLParams)
+			if got != test.want {
+				t.Fatalf("wrong query, want %q, got %q", test.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+)
+
+// byHashPattern matches the paths apt uses to fetch index files by their
+// content hash, e.g. `/dists/buster/main/binary-amd64/by-hash/SHA256/<digest>`.
+var byHashPattern = regexp.MustCompile(`/by-hash/(MD5Sum|SHA1|SHA256|SHA512)/([0-9a-f]+)$`)
+
+var byHashFuncs = map[string]func() hash.Hash{
+	"MD5Sum": md5.New,
+	"SHA1":   sha1.New,
+	"SHA256": sha256.New,
+	"SHA512": sha512.New,
+}
+
+// parseByHash returns the hash function and the expected digest for a by-hash
+// path. For all other paths, ok is false.
+func parseByHash(p string) (h hash.Hash, digest string, ok bool) {
+	m := byHashPattern.FindStringSubmatch(p)
+	if m == nil {
+		return nil, "", false
+	}
+
+	return byHashFuncs[m[1]](), m[2], true
+}
+
+// maxByHashSize limits the size of by-hash files, which are stored in a
+// temporary file until the digest has been verified.
+var maxByHashSize int64 = 1 << 30
+
+// readVerified reads all data from rd into a temporary file and returns it
+// (positioned at the start) with the size if the hash h of the data matches
+// the hex-encoded digest. The file is removed from the file system right
+// away, the caller must close it.
+func readVerified(rd io.Reader, h hash.Hash, digest string) (*os.File, int64, error) {
+	f, err := ioutil.TempFile("", "distriproxy-by-hash-")
+	if err != nil {
+		return nil, 0, err
+	}
+	_ = os.Remove(f.Name())
+
+	n, err := io.Copy(io.MultiWriter(f, h), io.LimitReader(rd, maxByHashSize+1))
+	if err == nil && n > maxByHashSize {
+		err = fmt.Errorf("file is larger than %d bytes", maxByHashSize)
+	}
+
+	if err == nil {
+		sum := hex.EncodeToString(h.Sum(nil))
+		if sum != digest {
+			err = fmt.Errorf("digest mismatch, got %v", sum)
+		}
+	}
+
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+
+	if err != nil {
+		_ = f.Close()
+		return nil, 0, err
+	}
+
+	return f, n, nil
+}
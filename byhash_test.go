@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func sha256Hex(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestParseByHash(t *testing.T) {
+	var tests = []struct {
+		path   string
+		ok     bool
+		digest string
+	}{
+		{"/dists/buster/main/binary-amd64/by-hash/SHA256/abc123", true, "abc123"},
+		{"/dists/buster/main/by-hash/MD5Sum/0123", true, "0123"},
+		{"/dists/buster/main/by-hash/SHA1/ff", true, "ff"},
+		{"/dists/buster/main/by-hash/SHA512/00", true, "00"},
+		{"/dists/buster/main/by-hash/SHA384/00", false, ""},
+		{"/dists/buster/main/by-hash/SHA256/ABC", false, ""},
+		{"/dists/buster/main/by-hash/SHA256/abc/x", false, ""},
+		{"/dists/buster/InRelease", false, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			h, digest, ok := parseByHash(test.path)
+			if ok != test.ok {
+				t.Fatalf("wrong result, want %v, got %v", test.ok, ok)
+			}
+
+			if !ok {
+				return
+			}
+
+			if h == nil {
+				t.Fatal("hash function is nil")
+			}
+
+			if digest != test.digest {
+				t.Fatalf("wrong digest, want %q, got %q", test.digest, digest)
+			}
+		})
+	}
+}
+
+func TestReadVerified(t *testing.T) {
+	const data = "Package: foo\nVersion: 1.0\n"
+
+	var tests = []struct {
+		name    string
+		data    string
+		digest  string
+		maxSize int64
+		ok      bool
+	}{
+		{"valid", data, sha256Hex(data), 1 << 20, true},
+		{"empty", "", sha256Hex(""), 1 << 20, true},
+		{"bad-digest", data, sha256Hex("other data"), 1 << 20, false},
+		{"truncated", data[:10], sha256Hex(data), 1 << 20, false},
+		{"exact-size", data, sha256Hex(data), int64(len(data)), true},
+		{"too-large", data, sha256Hex(data), int64(len(data)) - 1, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			defer func(size int64) {
+				maxByHashSize = size
+			}(maxByHashSize)
+			maxByHashSize = test.maxSize
+
+			f, n, err := readVerified(strings.NewReader(test.data), sha256.New(), test.digest)
+			if !test.ok {
+				if err == nil {
+					_ = f.Close()
+					t.Fatal("expected error not found")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer func() {
+				_ = f.Close()
+			}()
+
+			if n != int64(len(test.data)) {
+				t.Errorf("wrong size, want %d, got %d", len(test.data), n)
+			}
+
+			buf, err := ioutil.ReadAll(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(buf) != test.data {
+				t.Errorf("wrong data returned, want %q, got %q", test.data, buf)
+			}
+		})
+	}
+}
+
+func TestProxyByHash(t *testing.T) {
+	const data = "Package: foo\nVersion: 1.0\n"
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte(data))
+	}))
+	defer upstream.Close()
+
+	verify := true
+	srv := newTestProxy(t, Path{Path: "/debian", URL: upstream.URL, VerifyByHash: &verify})
+	defer srv.Close()
+
+	var tests = []struct {
+		path   string
+		status int
+	}{
+		{"/debian/dists/buster/main/by-hash/SHA256/" + sha256Hex(data), http.StatusOK},
+		{"/debian/dists/buster/main/by-hash/SHA256/" + sha256Hex("other data"), http.StatusBadGateway},
+		{"/debian/dists/buster/main/binary-amd64/Packages", http.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			res, body := get(t, srv.URL+test.path)
+
+			if res.StatusCode != test.status {
+				t.Fatalf("wrong status, want %v, got %v", test.status, res.StatusCode)
+			}
+
+			if test.status == http.StatusOK && body != data {
+				t.Fatalf("wrong body, want %q, got %q", data, body)
+			}
+		})
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/proxy"
+)
+
+// transportKey collects the settings which require a separate http.Transport.
+// Paths with the same settings share a transport and thereby the connection
+// pool.
+type transportKey struct {
+	caFile         string
+	clientCertFile string
+	clientKeyFile  string
+	headerTimeout  string
+	proxy          string
+}
+
+// clientFactory builds the HTTP clients used by the proxies for the paths.
+type clientFactory struct {
+	cfg        Config
+	transports map[transportKey]*http.Transport
+}
+
+func newClientFactory(cfg Config) *clientFactory {
+	return &clientFactory{
+		cfg:        cfg,
+		transports: make(map[transportKey]*http.Transport),
+	}
+}
+
+// stringValue returns the first non-nil value of values, or the empty string.
+func stringValue(values ...*string) string {
+	for _, v := range values {
+		if v != nil {
+			return *v
+		}
+	}
+	return ""
+}
+
+// clientFor returns an HTTP client for the path, honoring the upstream
+// settings for the path and the global defaults from the config file.
+func (f *clientFactory) clientFor(path Path) (*http.Client, error) {
+	key := transportKey{
+		caFile:         stringValue(path.UpstreamCAFile, f.cfg.UpstreamCAFile),
+		clientCertFile: stringValue(path.UpstreamClientCertFile, f.cfg.UpstreamClientCertFile),
+		clientKeyFile:  stringValue(path.UpstreamClientKeyFile, f.cfg.UpstreamClientKeyFile),
+		headerTimeout:  stringValue(path.UpstreamTimeout, f.cfg.UpstreamTimeout),
+		proxy:          stringValue(path.UpstreamProxy, f.cfg.UpstreamProxy),
+	}
+
+	tr, ok := f.transports[key]
+	if !ok {
+		var err error
+		tr, err = newTransport(f.cfg, key)
+		if err != nil {
+			return nil, fmt.Errorf("path %v: %v", path.Path, err)
+		}
+		f.transports[key] = tr
+	}
+
+	return &http.Client{Transport: tr}, nil
+}
+
+// newTransport returns an http.Transport for the connections to the upstream
+// servers. It uses the same settings as http.DefaultTransport, the connection
+// pool can be tuned in the config file.
+func newTransport(cfg Config, key transportKey) (*http.Transport, error) {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		DualStack: true,
+	}
+
+	tr := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+
+		// pass on the Accept-Encoding header of the client unchanged,
+		// otherwise the transport requests gzip and decompresses the
+		// response itself
+		DisableCompression: true,
+	}
+
+	if cfg.MaxIdleConns != nil {
+		tr.MaxIdleConns = *cfg.MaxIdleConns
+	}
+
+	if cfg.MaxIdleConnsPerHost != nil {
+		tr.MaxIdleConnsPerHost = *cfg.MaxIdleConnsPerHost
+	}
+
+	if cfg.IdleConnTimeout != nil {
+		d, err := time.ParseDuration(*cfg.IdleConnTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid idle_conn_timeout: %v", err)
+		}
+		tr.IdleConnTimeout = d
+	}
+
+	if key.headerTimeout != "" {
+		d, err := time.ParseDuration(key.headerTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid upstream_timeout: %v", err)
+		}
+		tr.ResponseHeaderTimeout = d
+	}
+
+	if key.proxy != "" {
+		err := setUpstreamProxy(tr, dialer, key.proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid upstream_proxy: %v", err)
+		}
+	}
+
+	tlsConfig := &tls.Config{}
+
+	if key.caFile != "" {
+		buf, err := ioutil.ReadFile(key.caFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading upstream_ca_file failed: %v", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(buf) {
+			return nil, errors.New("upstream_ca_file does not contain any certificates")
+		}
+
+		tlsConfig.RootCAs = pool
+	}
+
+	if key.clientCertFile != "" || key.clientKeyFile != "" {
+		if key.clientCertFile == "" || key.clientKeyFile == "" {
+			return nil, errors.New("upstream_client_cert_file and upstream_client_key_file must be set together")
+		}
+
+		cert, err := tls.LoadX509KeyPair(key.clientCertFile, key.clientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading upstream client certificate failed: %v", err)
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if tlsConfig.RootCAs != nil || len(tlsConfig.Certificates) > 0 {
+		tr.TLSClientConfig = tlsConfig
+	}
+
+	// the TLS config must be complete at this point, the http2 package
+	// adds "h2" to the protocols offered via ALPN
+	if cfg.UpstreamHTTP2 != nil && *cfg.UpstreamHTTP2 {
+		err := http2.ConfigureTransport(tr)
+		if err != nil {
+			return nil, fmt.Errorf("enabling HTTP/2 failed: %v", err)
+		}
+	} else {
+		// a non-nil map disables HTTP/2
+		tr.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+
+	return tr, nil
+}
+
+// setUpstreamProxy configures tr to connect to the upstream servers via the
+// proxy, either an HTTP proxy (http:// or https://) or a SOCKS5 proxy
+// (socks5://). The special value "direct" disables the proxy settings from the
+// environment.
+func setUpstreamProxy(tr *http.Transport, dialer *net.Dialer, proxyURL string) error {
+	if proxyURL == "direct" {
+		tr.Proxy = nil
+		return nil
+	}
+
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return err
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		tr.Proxy = http.ProxyURL(u)
+	case "socks5", "socks5h":
+		d, err := proxy.FromURL(u, dialer)
+		if err != nil {
+			return err
+		}
+
+		cd, ok := d.(proxy.ContextDialer)
+		if !ok {
+			return errors.New("SOCKS5 dialer does not support contexts")
+		}
+
+		tr.Proxy = nil
+		tr.DialContext = cd.DialContext
+	default:
+		return fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+
+	return nil
+}
@@ -0,0 +1,501 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUpstreamHTTP2(t *testing.T) {
+	cert, certPEM := newTestCertificate(t)
+
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(rw, req.Proto)
+	}))
+	upstream.TLS = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+	upstream.StartTLS()
+	defer upstream.Close()
+
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	caFile := filepath.Join(dir, "ca.pem")
+	err := ioutil.WriteFile(caFile, certPEM, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	enabled, disabled := true, false
+
+	var tests = []struct {
+		name          string
+		upstreamHTTP2 *bool
+		want          string
+	}{
+		{"default", nil, "HTTP/1.1"},
+		{"disabled", &disabled, "HTTP/1.1"},
+		{"enabled", &enabled, "HTTP/2.0"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := Config{UpstreamCAFile: &caFile, UpstreamHTTP2: test.upstreamHTTP2}
+			path := Path{Path: "/debian", URL: upstream.URL}
+
+			client, err := newClientFactory(cfg).clientFor(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			proxy, err := NewProxy(path, client, &Shared{LogLevel: LogError})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			mux := http.NewServeMux()
+			mux.Handle("/debian/", proxy)
+			srv := httptest.NewServer(mux)
+			defer srv.Close()
+
+			res, body := get(t, srv.URL+"/debian/proto")
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("unexpected status %v: %q", res.Status, body)
+			}
+
+			if body != test.want {
+				t.Fatalf("wrong protocol for upstream request, want %v, got %v", test.want, body)
+			}
+		})
+	}
+}
+
+// newHTTPProxy returns an HTTP proxy server which records the URLs of the
+// requests it has forwarded.
+func newHTTPProxy() (*httptest.Server, func() []string) {
+	var m sync.Mutex
+	var urls []string
+
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		m.Lock()
+		urls = append(urls, req.URL.String())
+		m.Unlock()
+
+		outreq := new(http.Request)
+		*outreq = *req
+		outreq.RequestURI = ""
+
+		res, err := http.DefaultTransport.RoundTrip(outreq)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer func() {
+			_ = res.Body.Close()
+		}()
+
+		for name, values := range res.Header {
+			rw.Header()[name] = values
+		}
+		rw.Header().Set("X-Via-Test-Proxy", "1")
+		rw.WriteHeader(res.StatusCode)
+		_, _ = io.Copy(rw, res.Body)
+	}))
+
+	return srv, func() []string {
+		m.Lock()
+		defer m.Unlock()
+		return append([]string{}, urls...)
+	}
+}
+
+func TestUpstreamProxy(t *testing.T) {
+	upstream := echoRequest()
+	defer upstream.Close()
+
+	proxySrv, proxied := newHTTPProxy()
+	defer proxySrv.Close()
+
+	var tests = []struct {
+		name        string
+		globalProxy *string
+		pathProxy   *string
+		viaProxy    bool
+	}{
+		{"none", nil, nil, false},
+		{"global", &proxySrv.URL, nil, true},
+		{"path", nil, &proxySrv.URL, true},
+		{"path-direct", &proxySrv.URL, stringPtr("direct"), false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := Config{UpstreamProxy: test.globalProxy}
+			path := Path{Path: "/debian", URL: upstream.URL + "/debian", UpstreamProxy: test.pathProxy}
+
+			client, err := newClientFactory(cfg).clientFor(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			proxy, err := NewProxy(path, client, &Shared{LogLevel: LogError})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			mux := http.NewServeMux()
+			mux.Handle("/debian/", proxy)
+			srv := httptest.NewServer(mux)
+			defer srv.Close()
+
+			before := len(proxied())
+
+			res, body := get(t, srv.URL+"/debian/dists/"+test.name+"/Release")
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("unexpected status %v: %q", res.Status, body)
+			}
+
+			if !strings.HasPrefix(body, "GET /debian/dists/"+test.name+"/Release ") {
+				t.Fatalf("wrong upstream request %q", body)
+			}
+
+			urls := proxied()[before:]
+			if !test.viaProxy {
+				if len(urls) != 0 {
+					t.Fatalf("request was sent via the proxy: %v", urls)
+				}
+				return
+			}
+
+			want := upstream.URL + "/debian/dists/" + test.name + "/Release"
+			if len(urls) != 1 || urls[0] != want {
+				t.Fatalf("wrong requests sent via the proxy, want %v, got %v", want, urls)
+			}
+
+			if res.Header.Get("X-Via-Test-Proxy") != "1" {
+				t.Fatalf("response not received via the proxy")
+			}
+		})
+	}
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
+
+func TestSetUpstreamProxy(t *testing.T) {
+	req, err := http.NewRequest(http.MethodGet, "http://deb.debian.org/debian/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		proxy string
+		err   bool
+		want  string
+	}{
+		{"direct", false, ""},
+		{"http://127.0.0.1:3128", false, "http://127.0.0.1:3128"},
+		{"https://proxy.example.com", false, "https://proxy.example.com"},
+		{"socks5://127.0.0.1:1080", false, ""},
+		{"socks5h://127.0.0.1:1080", false, ""},
+		{"ftp://127.0.0.1:21", true, ""},
+		{"127.0.0.1:3128", true, ""},
+		{"http://[::1", true, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.proxy, func(t *testing.T) {
+			tr := &http.Transport{Proxy: http.ProxyFromEnvironment}
+			err := setUpstreamProxy(tr, &net.Dialer{}, test.proxy)
+			if test.err {
+				if err == nil {
+					t.Fatal("invalid proxy accepted")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if test.want == "" {
+				if tr.Proxy != nil {
+					t.Fatal("proxy from environment still used")
+				}
+				return
+			}
+
+			u, err := tr.Proxy(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if u == nil || u.String() != test.want {
+				t.Fatalf("wrong proxy, want %v, got %v", test.want, u)
+			}
+		})
+	}
+}
+
+func intPtr(i int) *int {
+	return &i
+}
+
+func TestNewTransport(t *testing.T) {
+	var tests = []struct {
+		name                string
+		cfg                 Config
+		key                 transportKey
+		maxIdleConns        int
+		maxIdleConnsPerHost int
+		idleConnTimeout     time.Duration
+		headerTimeout       time.Duration
+		ok                  bool
+	}{
+		{"default", Config{}, transportKey{}, 100, 0, 90 * time.Second, 0, true},
+		{"pool", Config{
+			MaxIdleConns:        intPtr(500),
+			MaxIdleConnsPerHost: intPtr(20),
+			IdleConnTimeout:     stringPtr("5m"),
+		}, transportKey{}, 500, 20, 5 * time.Minute, 0, true},
+		{"header-timeout", Config{MaxIdleConnsPerHost: intPtr(4)},
+			transportKey{headerTimeout: "15s"}, 100, 4, 90 * time.Second, 15 * time.Second, true},
+		{"invalid-idle-conn-timeout", Config{IdleConnTimeout: stringPtr("5 minutes")},
+			transportKey{}, 0, 0, 0, 0, false},
+		{"invalid-header-timeout", Config{}, transportKey{headerTimeout: "soon"}, 0, 0, 0, 0, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tr, err := newTransport(test.cfg, test.key)
+			if !test.ok {
+				if err == nil {
+					t.Fatal("expected error not found")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tr.MaxIdleConns != test.maxIdleConns {
+				t.Errorf("wrong MaxIdleConns, want %v, got %v", test.maxIdleConns, tr.MaxIdleConns)
+			}
+
+			if tr.MaxIdleConnsPerHost != test.maxIdleConnsPerHost {
+				t.Errorf("wrong MaxIdleConnsPerHost, want %v, got %v", test.maxIdleConnsPerHost, tr.MaxIdleConnsPerHost)
+			}
+
+			if tr.IdleConnTimeout != test.idleConnTimeout {
+				t.Errorf("wrong IdleConnTimeout, want %v, got %v", test.idleConnTimeout, tr.IdleConnTimeout)
+			}
+
+			if tr.ResponseHeaderTimeout != test.headerTimeout {
+				t.Errorf("wrong ResponseHeaderTimeout, want %v, got %v", test.headerTimeout, tr.ResponseHeaderTimeout)
+			}
+		})
+	}
+}
+
+// countConns returns a server which counts the connections it has accepted.
+func countConns() (*httptest.Server, func() int) {
+	var m sync.Mutex
+	var conns int
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(rw, "hello\n")
+	}))
+	srv.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			m.Lock()
+			conns++
+			m.Unlock()
+		}
+	}
+	srv.Start()
+
+	return srv, func() int {
+		m.Lock()
+		defer m.Unlock()
+		return conns
+	}
+}
+
+// fetch requests url with client and reads the body, so the connection can
+// be reused.
+func fetch(client *http.Client, url string) error {
+	res, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(ioutil.Discard, res.Body)
+	if err != nil {
+		_ = res.Body.Close()
+		return err
+	}
+
+	return res.Body.Close()
+}
+
+func TestTransportReuse(t *testing.T) {
+	upstream, conns := countConns()
+	defer upstream.Close()
+
+	tr, err := newTransport(Config{}, transportKey{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: tr}
+
+	for i := 0; i < 10; i++ {
+		err = fetch(client, upstream.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if conns() != 1 {
+		t.Fatalf("connection not reused, want 1 connection, got %d", conns())
+	}
+}
+
+func BenchmarkTransport(b *testing.B) {
+	upstream, conns := countConns()
+	defer upstream.Close()
+
+	tr, err := newTransport(Config{}, transportKey{})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	// without keep-alive every request needs a new connection
+	noReuse, err := newTransport(Config{}, transportKey{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	noReuse.DisableKeepAlives = true
+
+	var benchmarks = []struct {
+		name string
+		tr   *http.Transport
+	}{
+		{"reuse", tr},
+		{"no-reuse", noReuse},
+	}
+
+	for _, bench := range benchmarks {
+		b.Run(bench.name, func(b *testing.B) {
+			client := &http.Client{Transport: bench.tr}
+			before := conns()
+
+			for i := 0; i < b.N; i++ {
+				err := fetch(client, upstream.URL)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			b.Logf("%d requests, %d new connections", b.N, conns()-before)
+		})
+	}
+}
+
+func TestClientFor(t *testing.T) {
+	cfg := Config{
+		UpstreamTimeout: stringPtr("30s"),
+		MaxIdleConns:    intPtr(50),
+	}
+
+	paths := []Path{
+		{Path: "/debian", URL: "https://deb.debian.org/debian"},
+		{Path: "/debian-security", URL: "https://deb.debian.org/debian-security"},
+		// same value as the global default
+		{Path: "/ubuntu", URL: "http://archive.ubuntu.com/ubuntu", UpstreamTimeout: stringPtr("30s")},
+		{Path: "/slow", URL: "https://slow.example.com", UpstreamTimeout: stringPtr("2m")},
+		{Path: "/proxied", URL: "https://example.com", UpstreamProxy: stringPtr("http://proxy.example.com:3128")},
+	}
+
+	f := newClientFactory(cfg)
+
+	transports := make(map[string]*http.Transport)
+	for _, path := range paths {
+		client, err := f.clientFor(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		transports[path.Path] = client.Transport.(*http.Transport)
+	}
+
+	var tests = []struct {
+		a, b   string
+		shared bool
+	}{
+		{"/debian", "/debian-security", true},
+		{"/debian", "/ubuntu", true},
+		{"/debian", "/slow", false},
+		{"/debian", "/proxied", false},
+		{"/slow", "/proxied", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.a+test.b, func(t *testing.T) {
+			shared := transports[test.a] == transports[test.b]
+			if shared != test.shared {
+				t.Fatalf("wrong transport sharing for %v and %v, want %v, got %v", test.a, test.b, test.shared, shared)
+			}
+		})
+	}
+
+	if len(f.transports) != 3 {
+		t.Fatalf("wrong number of transports, want 3, got %d", len(f.transports))
+	}
+
+	// the settings are applied to all transports
+	var timeouts = map[string]time.Duration{
+		"/debian":  30 * time.Second,
+		"/slow":    2 * time.Minute,
+		"/proxied": 30 * time.Second,
+	}
+
+	for path, timeout := range timeouts {
+		tr := transports[path]
+		if tr.ResponseHeaderTimeout != timeout {
+			t.Errorf("%v: wrong ResponseHeaderTimeout, want %v, got %v", path, timeout, tr.ResponseHeaderTimeout)
+		}
+
+		if tr.MaxIdleConns != 50 {
+			t.Errorf("%v: wrong MaxIdleConns, want 50, got %v", path, tr.MaxIdleConns)
+		}
+	}
+}
+
+func TestClientForInvalid(t *testing.T) {
+	f := newClientFactory(Config{})
+
+	_, err := f.clientFor(Path{Path: "/debian", URL: "https://deb.debian.org/debian", UpstreamTimeout: stringPtr("soon")})
+	if err == nil {
+		t.Fatal("expected error not found")
+	}
+
+	if !strings.HasPrefix(err.Error(), "path /debian: ") {
+		t.Fatalf("path missing from error %q", err)
+	}
+
+	if len(f.transports) != 0 {
+		t.Fatalf("invalid transport was stored")
+	}
+}
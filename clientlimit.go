@@ -0,0 +1,127 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// clientIdleTimeout is the time after which the state for a client without
+// requests is removed.
+const clientIdleTimeout = 5 * time.Minute
+
+// ClientLimiter limits the request rate and the number of concurrent requests
+// per client IP address. The rate is enforced with a token bucket per client,
+// which holds up to burst tokens and is refilled with rate tokens per second.
+type ClientLimiter struct {
+	rate          float64
+	burst         float64
+	maxConcurrent int
+
+	m         sync.Mutex
+	clients   map[string]*clientState
+	lastPrune time.Time
+}
+
+type clientState struct {
+	tokens   float64
+	last     time.Time
+	inFlight int
+}
+
+// NewClientLimiter returns a limiter allowing rate requests per second with
+// bursts of up to burst requests, and maxConcurrent concurrent requests per
+// client. Zero disables the respective limit, if burst is zero it is set to
+// the rate (but at least one).
+func NewClientLimiter(rate float64, burst, maxConcurrent int) *ClientLimiter {
+	l := &ClientLimiter{
+		rate:          rate,
+		burst:         float64(burst),
+		maxConcurrent: maxConcurrent,
+		clients:       make(map[string]*clientState),
+		lastPrune:     time.Now(),
+	}
+
+	if l.burst <= 0 {
+		l.burst = math.Max(1, math.Ceil(rate))
+	}
+
+	return l
+}
+
+// prune removes clients which have not sent requests for some time, the
+// caller must hold l.m.
+func (l *ClientLimiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < clientIdleTimeout {
+		return
+	}
+
+	for ip, c := range l.clients {
+		if c.inFlight == 0 && now.Sub(c.last) > clientIdleTimeout {
+			delete(l.clients, ip)
+		}
+	}
+
+	l.lastPrune = now
+}
+
+// acquire checks whether a request from ip is allowed. On success, the
+// returned function must be called when the request is done. Otherwise the
+// number of seconds after which the client may try again is returned.
+func (l *ClientLimiter) acquire(ip string) (release func(), retryAfter int) {
+	now := time.Now()
+
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	l.prune(now)
+
+	c, ok := l.clients[ip]
+	if !ok {
+		c = &clientState{tokens: l.burst, last: now}
+		l.clients[ip] = c
+	}
+
+	if l.rate > 0 {
+		c.tokens = math.Min(l.burst, c.tokens+now.Sub(c.last).Seconds()*l.rate)
+	}
+	c.last = now
+
+	if l.maxConcurrent > 0 && c.inFlight >= l.maxConcurrent {
+		return nil, 1
+	}
+
+	if l.rate > 0 {
+		if c.tokens < 1 {
+			return nil, int(math.Ceil((1 - c.tokens) / l.rate))
+		}
+		c.tokens--
+	}
+
+	c.inFlight++
+	return func() {
+		l.m.Lock()
+		c.inFlight--
+		l.m.Unlock()
+	}, 0
+}
+
+// LimitClients passes requests to next unless the client has exceeded its
+// limits, these requests are answered with 429 and a Retry-After header.
+func LimitClients(next http.Handler, limiter *ClientLimiter, shared *Shared) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		ip := clientIP(req)
+
+		release, retryAfter := limiter.acquire(ip)
+		if release == nil {
+			rw.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			shared.writeError(rw, req, "", errTooManyRequests("%v %v %v client limit exceeded", ip, req.Method, req.URL.Path))
+			return
+		}
+		defer release()
+
+		next.ServeHTTP(rw, req)
+	})
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientLimiterRate(t *testing.T) {
+	var tests = []struct {
+		name       string
+		rate       float64
+		burst      int
+		requests   int
+		allowed    int
+		retryAfter int
+	}{
+		{"unlimited", 0, 0, 50, 50, 0},
+		{"burst", 1, 5, 10, 5, 1},
+		{"default-burst", 3, 0, 10, 3, 1},
+		{"default-burst-slow", 0.5, 0, 10, 1, 2},
+		{"slow", 0.1, 2, 10, 2, 10},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			l := NewClientLimiter(test.rate, test.burst, 0)
+
+			allowed := 0
+			retryAfter := 0
+			for i := 0; i < test.requests; i++ {
+				release, retry := l.acquire("192.0.2.1")
+				if release == nil {
+					retryAfter = retry
+					continue
+				}
+
+				allowed++
+				release()
+			}
+
+			if allowed != test.allowed {
+				t.Errorf("wrong number of requests allowed, want %d, got %d", test.allowed, allowed)
+			}
+
+			if retryAfter != test.retryAfter {
+				t.Errorf("wrong retry after, want %d, got %d", test.retryAfter, retryAfter)
+			}
+
+			// other clients have their own bucket
+			release, _ := l.acquire("192.0.2.2")
+			if release == nil {
+				t.Fatal("request from another client was rejected")
+			}
+			release()
+		})
+	}
+}
+
+func TestClientLimiterConcurrent(t *testing.T) {
+	l := NewClientLimiter(0, 0, 2)
+
+	var releases []func()
+	for i := 0; i < 2; i++ {
+		release, _ := l.acquire("192.0.2.1")
+		if release == nil {
+			t.Fatalf("request %d was rejected", i)
+		}
+		releases = append(releases, release)
+	}
+
+	release, retryAfter := l.acquire("192.0.2.1")
+	if release != nil {
+		t.Fatal("request above the concurrency limit was allowed")
+	}
+
+	if retryAfter != 1 {
+		t.Fatalf("wrong retry after, want 1, got %d", retryAfter)
+	}
+
+	releases[0]()
+
+	release, _ = l.acquire("192.0.2.1")
+	if release == nil {
+		t.Fatal("request was rejected after another one has finished")
+	}
+	release()
+	releases[1]()
+}
+
+func TestLimitClients(t *testing.T) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte("ok"))
+	})
+
+	srv := httptest.NewServer(LimitClients(next, NewClientLimiter(0.1, 2, 0), &Shared{LogLevel: LogError}))
+	defer srv.Close()
+
+	var tests = []struct {
+		status     int
+		retryAfter string
+	}{
+		{http.StatusOK, ""},
+		{http.StatusOK, ""},
+		{http.StatusTooManyRequests, "10"},
+	}
+
+	for i, test := range tests {
+		res, _ := get(t, srv.URL+"/debian/x.deb")
+		if res.StatusCode != test.status {
+			t.Fatalf("request %d: wrong status, want %v, got %v", i, test.status, res.StatusCode)
+		}
+
+		if res.Header.Get("Retry-After") != test.retryAfter {
+			t.Fatalf("request %d: wrong Retry-After, want %q, got %q", i, test.retryAfter, res.Header.Get("Retry-After"))
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"fmt"
+
 	"github.com/hashicorp/hcl2/gohcl"
 	"github.com/hashicorp/hcl2/hclparse"
 )
@@ -14,18 +16,330 @@ type Config struct {
 	TLSKeyFile         *string `hcl:"tls_key_file"`
 	TLSEnable          *bool   `hcl:"tls_enable"`
 
-	Paths []Path `hcl:"path,block"`
+	// HTTP2 can be set to false to disable HTTP/2 on TLS listeners, H2C
+	// enables HTTP/2 without TLS on plaintext listeners (with prior
+	// knowledge or via Upgrade: h2c). UpstreamHTTP2 enables HTTP/2 for
+	// connections to upstream servers via https, which is disabled by
+	// default.
+	HTTP2         *bool `hcl:"http2"`
+	H2C           *bool `hcl:"h2c"`
+	UpstreamHTTP2 *bool `hcl:"upstream_http2"`
+
+	// Listen is the address to listen on when no socket is passed in by
+	// systemd, either host:port or unix:/path/to/socket. SocketActivation can
+	// be set to false to ignore such sockets. ListenSocketMode sets the
+	// permissions (octal, e.g. "0660") of a Unix domain socket.
+	Listen           *string `hcl:"listen"`
+	ListenSocketMode *string `hcl:"listen_socket_mode"`
+	SocketActivation *bool   `hcl:"socket_activation"`
+
+	// LogFormat enables access logs on stdout, either "common" or "combined"
+	LogFormat *string `hcl:"log_format"`
+
+	// AccessLogFile writes the access log to a file instead of stdout. The
+	// lines are buffered (AccessLogBufferSize bytes, 64KiB by default) and
+	// written every AccessLogFlushInterval (default 1s) and on shutdown.
+	// SIGHUP reopens the file after it has been rotated. With
+	// AccessLogCompress, SIGHUP makes distriproxy rotate the file itself:
+	// it is renamed with the current time appended and compressed with gzip.
+	AccessLogFile          *string `hcl:"access_log_file"`
+	AccessLogBufferSize    *int    `hcl:"access_log_buffer_size"`
+	AccessLogFlushInterval *string `hcl:"access_log_flush_interval"`
+	AccessLogCompress      *bool   `hcl:"access_log_compress"`
+
+	// LogLevel is one of "error", "warn", "info" (default) or "debug"
+	LogLevel *string `hcl:"log_level"`
+
+	// LogSampleRate logs only a fraction (e.g. 0.1) of the successful
+	// requests to the configured paths, errors are always logged
+	LogSampleRate *float64 `hcl:"log_sample_rate"`
+
+	// connection pool for the upstream servers
+	MaxIdleConns        *int    `hcl:"max_idle_conns"`
+	MaxIdleConnsPerHost *int    `hcl:"max_idle_conns_per_host"`
+	IdleConnTimeout     *string `hcl:"idle_conn_timeout"`
+
+	// UserAgent is sent to the upstream servers, the default is
+	// distriproxy/<version>. An empty string sends no User-Agent at all, the
+	// client's User-Agent is never passed on.
+	UserAgent *string `hcl:"user_agent"`
+
+	// FilterRequestHeaders lists the request header fields which are not
+	// sent to the upstream servers, replacing the default list (see
+	// defaultFilterRequestHeaders). Fields named in the Connection header
+	// are never sent.
+	FilterRequestHeaders []string `hcl:"filter_request_headers,optional"`
+
+	// FilterResponseHeaders lists the header fields of upstream responses
+	// which are not passed on to clients, replacing the default (Set-Cookie
+	// and Set-Cookie2). If AllowResponseHeaders is set, only the fields it
+	// lists are passed on, in addition to those needed for transferring the
+	// body (e.g. Content-Length).
+	FilterResponseHeaders []string `hcl:"filter_response_headers,optional"`
+	AllowResponseHeaders  []string `hcl:"allow_response_headers,optional"`
+
+	// ServerHeader replaces the Server header in all responses, including
+	// those from upstream servers, the default is distriproxy/<version>. It
+	// can be set to "" to not send the header at all.
+	ServerHeader *string `hcl:"server_header"`
+
+	// AllowForwardProxy enables handling requests sent to distriproxy as an
+	// HTTP proxy. Requests for the upstream of a configured path are handled
+	// by that path, others are forwarded if the host is in ForwardProxyHosts
+	AllowForwardProxy *bool    `hcl:"allow_forward_proxy"`
+	ForwardProxyHosts []string `hcl:"forward_proxy_hosts,optional"`
+
+	// AllowedMethods lists the HTTP methods accepted from clients, GET and
+	// HEAD by default. Other requests are answered with 405. Request bodies
+	// are not passed on to the upstream servers.
+	AllowedMethods []string `hcl:"allowed_methods,optional"`
+
+	// RobotsTxtFile is served as /robots.txt, by default all crawling is
+	// disallowed. Requests with a User-Agent matching the regular expression
+	// BlockUserAgents are rejected.
+	RobotsTxtFile   *string `hcl:"robots_txt_file"`
+	BlockUserAgents *string `hcl:"block_user_agents"`
+
+	// VerifyUpstreams checks all upstreams at startup, with
+	// FailOnUnreachable set distriproxy refuses to start if one of them
+	// cannot be reached
+	VerifyUpstreams   *bool `hcl:"verify_upstreams"`
+	FailOnUnreachable *bool `hcl:"fail_on_unreachable"`
+
+	// Maintenance disables all requests to upstream servers, they are
+	// answered with 503 and a Retry-After header of MaintenanceRetryAfter
+	// (default 5m). Only paths with a file:// URL are served. Sending
+	// SIGUSR1 toggles maintenance mode at runtime.
+	Maintenance           *bool   `hcl:"maintenance"`
+	MaintenanceRetryAfter *string `hcl:"maintenance_retry_after"`
+
+	// EnableStatus serves statistics for all paths as JSON on /status
+	EnableStatus *bool `hcl:"enable_status"`
+
+	// defaults for the upstream settings of all paths
+	UpstreamTimeout        *string `hcl:"upstream_timeout"`
+	UpstreamCAFile         *string `hcl:"upstream_ca_file"`
+	UpstreamClientCertFile *string `hcl:"upstream_client_cert_file"`
+	UpstreamClientKeyFile  *string `hcl:"upstream_client_key_file"`
+	UpstreamProxy          *string `hcl:"upstream_proxy"`
+
+	// limits for concurrent upstream requests, requests above the limit
+	// wait up to UpstreamQueueTimeout and are then answered with 503
+	MaxConcurrentUpstream        *int    `hcl:"max_concurrent_upstream"`
+	MaxConcurrentUpstreamPerHost *int    `hcl:"max_concurrent_upstream_per_host"`
+	UpstreamQueueTimeout         *string `hcl:"upstream_queue_timeout"`
+
+	// ViaPseudonym is the name of distriproxy in the Via header of requests
+	// and responses, the host name by default. SendVia can be set to false
+	// to not send the header at all.
+	ViaPseudonym *string `hcl:"via_pseudonym"`
+	SendVia      *bool   `hcl:"send_via"`
+
+	// NodeID identifies this instance when several are chained, it is added
+	// to the X-Distriproxy-Hops header of upstream requests. Requests which
+	// already contain the ID are answered with 508.
+	NodeID *string `hcl:"node_id"`
+
+	// TrustedProxies lists the networks (in CIDR notation) of proxies in front
+	// of distriproxy. For requests from these, the client IP address is taken
+	// from the X-Forwarded-For or X-Real-IP header.
+	TrustedProxies []string `hcl:"trusted_proxies,optional"`
+
+	// limits per client IP address, ClientRateLimit is the number of
+	// requests per second with bursts of up to ClientRateBurst requests.
+	// Requests above the limits are answered with 429.
+	ClientRateLimit        *float64 `hcl:"client_rate_limit"`
+	ClientRateBurst        *int     `hcl:"client_rate_burst"`
+	MaxConcurrentPerClient *int     `hcl:"max_concurrent_per_client"`
+
+	// MaxRequestDuration aborts requests which take longer (e.g. because the
+	// client reads slowly), this includes the transfer of the response body.
+	// UpstreamTimeout only limits the wait for the upstream response header.
+	// Requests aborted before the response header has arrived are answered
+	// with 504.
+	MaxRequestDuration *string `hcl:"max_request_duration"`
+
+	// NegativeCacheTTL enables remembering 404 and 410 responses from the
+	// upstream servers for the duration, repeated requests are answered
+	// without contacting the upstream server.
+	NegativeCacheTTL *string `hcl:"negative_cache_ttl"`
+
+	// BufferThreshold is the size in bytes up to which upstream responses
+	// without a Content-Length are buffered, so that the client gets the
+	// length. Larger responses are streamed.
+	BufferThreshold *int `hcl:"buffer_threshold"`
+
+	// SlowRequestThreshold logs a warning for upstream requests which take
+	// longer until the response header arrives.
+	SlowRequestThreshold *string `hcl:"slow_request_threshold"`
+
+	// limits for the header of requests and upstream responses, by default
+	// MaxHeaderBytes is 64KiB, the number of header fields is limited to 100
+	MaxHeaderBytes     *int `hcl:"max_header_bytes"`
+	MaxRequestHeaders  *int `hcl:"max_request_headers"`
+	MaxResponseHeaders *int `hcl:"max_response_headers"`
+
+	// AdminListen is the address for administrative endpoints, which are not
+	// served on the public listeners. All requests must carry AdminToken as a
+	// bearer token. EnablePprof serves runtime profiles below /debug/pprof/.
+	AdminListen *string `hcl:"admin_listen"`
+	AdminToken  *string `hcl:"admin_token"`
+	EnablePprof *bool   `hcl:"enable_pprof"`
+
+	// ResponseHeaders modifies the header of all responses sent to clients,
+	// a path block can contain additional rules which are applied afterwards.
+	ResponseHeaders *ResponseHeaders `hcl:"response_headers,block"`
+
+	// Auth requires clients to authenticate for all paths (unless disabled
+	// for a path) and the status endpoint.
+	Auth *Auth `hcl:"auth,block"`
+
+	Listeners  []Listener  `hcl:"listener,block"`
+	Paths      []Path      `hcl:"path,block"`
+	ErrorPages []ErrorPage `hcl:"error_page,block"`
+}
+
+// Listener configures an address to accept connections on. When listener
+// blocks are present, listen and tls_enable are ignored. A plaintext listener
+// can redirect all requests to the first TLS listener.
+type Listener struct {
+	Address       string `hcl:"address"`
+	TLS           *bool  `hcl:"tls"`
+	RedirectHTTPS *bool  `hcl:"redirect_https"`
 }
 
 // Path configures one sub-path of the proxy.
+//
+// For example, using the path `/foo` and the URL `https://example.com/bar`,
+// requesting `/foo/x.tar.gz` would request the URL
+// `https://example.com/bar/x.tar.gz` in the background. A URL of the form
+// `file:///srv/mirror/foo` serves the files below the directory
+// `/srv/mirror/foo` directly from the local file system. The path `/` is the
+// default upstream, it handles all requests not matched by another path.
 type Path struct {
 	Path string `hcl:",label"`
 	URL  string `hcl:"url"`
+
+	// VerifyByHash checks that files requested via apt's by-hash paths match
+	// the digest in the path, mismatches are answered with 502.
+	VerifyByHash *bool `hcl:"verify_by_hash"`
+
+	// GPGKeyring is an OpenPGP keyring file, the signatures of InRelease
+	// files and of Release files (in Release.gpg) are verified against it.
+	// Files with an invalid signature are answered with 502.
+	GPGKeyring *string `hcl:"gpg_keyring"`
+
+	// UpstreamTimeout limits the time to wait for the response headers from
+	// the upstream server, UpstreamCAFile is a PEM file with the CA
+	// certificates to verify the upstream server with. Both override the
+	// global settings.
+	UpstreamTimeout *string `hcl:"upstream_timeout"`
+	UpstreamCAFile  *string `hcl:"upstream_ca_file"`
+
+	// UpstreamClientCertFile and UpstreamClientKeyFile configure a client
+	// certificate for upstream servers which require mutual TLS.
+	UpstreamClientCertFile *string `hcl:"upstream_client_cert_file"`
+	UpstreamClientKeyFile  *string `hcl:"upstream_client_key_file"`
+
+	// UpstreamProxy is the URL of an HTTP or SOCKS5 proxy for connecting to
+	// the upstream server, "direct" ignores the proxy configured in the
+	// environment (HTTP_PROXY, HTTPS_PROXY and NO_PROXY).
+	UpstreamProxy *string `hcl:"upstream_proxy"`
+
+	// ForwardQuery passes the query string of requests on to the upstream
+	// server, by default it is dropped. With signed URLs, the parameters
+	// expires and signature are removed.
+	ForwardQuery *bool `hcl:"forward_query"`
+
+	// MaxParallel limits the number of concurrent requests to the upstream
+	// server of this path (e.g. for mirrors which ban clients with too many
+	// connections), in addition to the global limits. Excess requests wait
+	// up to upstream_queue_timeout and are then answered with 503.
+	MaxParallel *int `hcl:"max_parallel"`
+
+	// UpstreamAuth configures credentials for upstream servers which
+	// require authentication.
+	UpstreamAuth *UpstreamAuth `hcl:"upstream_auth,block"`
+
+	// Log can be set to false to disable logging successful requests for
+	// the path, errors are still logged.
+	Log *bool `hcl:"log"`
+
+	// RequireAuth can be set to false to allow access to the path without
+	// credentials when an auth block is configured.
+	RequireAuth *bool `hcl:"require_auth"`
+
+	// StripPrefix is removed from the beginning of the request path and
+	// AddPrefix is prepended before the upstream URL is built, for mirrors
+	// with a different directory layout. Both are applied after the
+	// rewrites.
+	StripPrefix *string `hcl:"strip_prefix"`
+	AddPrefix   *string `hcl:"add_prefix"`
+
+	ResponseHeaders *ResponseHeaders `hcl:"response_headers,block"`
+	Rewrites        []Rewrite        `hcl:"rewrite,block"`
+}
+
+// ResponseHeaders modifies the header of responses sent to clients after
+// the header from the upstream server has been copied. The fields in Remove
+// are deleted first, then the fields in Set are set (replacing any existing
+// values).
+type ResponseHeaders struct {
+	Set    map[string]string `hcl:"set,optional" json:"set,omitempty"`
+	Remove []string          `hcl:"remove,optional" json:"remove,omitempty"`
+}
+
+// UpstreamAuth configures the credentials sent to an upstream server. Scheme
+// is either "basic" (credentials in the form "name:password") or "bearer"
+// (the token). The credentials are taken from exactly one of Credentials, the
+// file CredentialsFile or the environment variable CredentialsEnv.
+type UpstreamAuth struct {
+	Scheme          string  `hcl:"scheme"`
+	Credentials     *string `hcl:"credentials"`
+	CredentialsFile *string `hcl:"credentials_file"`
+	CredentialsEnv  *string `hcl:"credentials_env"`
+}
+
+// Auth configures the authentication of clients. Scheme is one of "bearer"
+// (using Tokens), "basic" (Users in the form "name:password") or "signed"
+// (query strings signed with Secret), see Authenticator.
+type Auth struct {
+	Scheme string   `hcl:"scheme"`
+	Tokens []string `hcl:"tokens,optional"`
+	Users  []string `hcl:"users,optional"`
+	Secret *string  `hcl:"secret"`
+}
+
+// Rewrite changes the request path before the upstream URL is constructed.
+// All matches of the regular expression Match are replaced by Replace, which
+// can refer to capture groups as $1 or ${name}. Several rewrite blocks are
+// applied in order.
+type Rewrite struct {
+	Match   string `hcl:"match"`
+	Replace string `hcl:"replace"`
+}
+
+// ErrorPage configures a template file which is rendered as the body for
+// error responses with the given status code.
+type ErrorPage struct {
+	Status   string `hcl:",label"`
+	Template string `hcl:"template"`
 }
 
 // DefaultConfig collects default config items.
 var DefaultConfig = Config{}
 
+// DefaultPaths are the upstream servers used when the config file does not
+// contain any path blocks.
+var DefaultPaths = []Path{
+	{Path: "/debian", URL: "https://deb.debian.org/debian"},
+	{Path: "/debian-security", URL: "https://deb.debian.org/debian-security"},
+	{Path: "/centos", URL: "https://ftp.halifax.rwth-aachen.de/centos"},
+	{Path: "/centos-vault", URL: "http://vault.centos.org"},
+	{Path: "/centos-debuginfo", URL: "http://debuginfo.centos.org"},
+	{Path: "/centos-epel", URL: "https://mirror.netcologne.de/fedora-epel"},
+}
+
 // ParseConfig returns a config from a file.
 func ParseConfig(filename string) (Config, error) {
 	var cfg = DefaultConfig
@@ -43,5 +357,28 @@ func ParseConfig(filename string) (Config, error) {
 		return Config{}, diags
 	}
 
+	if len(cfg.Paths) == 0 {
+		cfg.Paths = append([]Path(nil), DefaultPaths...)
+	}
+
+	err := checkPaths(cfg.Paths)
+	if err != nil {
+		return Config{}, err
+	}
+
 	return cfg, nil
 }
+
+// checkPaths returns an error if two path blocks handle the same prefix.
+func checkPaths(paths []Path) error {
+	seen := make(map[string]bool, len(paths))
+	for _, path := range paths {
+		prefix := pathPrefix(path.Path)
+		if seen[prefix] {
+			return fmt.Errorf("path %q is configured more than once", path.Path)
+		}
+		seen[prefix] = true
+	}
+
+	return nil
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseConfigPaths(t *testing.T) {
+	var tests = []struct {
+		name   string
+		config string
+		paths  int
+		ok     bool
+	}{
+		{"default", ``, len(DefaultPaths), true},
+		{"single", `path "/debian" { url = "https://deb.debian.org/debian" }`, 1, true},
+		{"default-upstream", `
+			path "/" { url = "https://example.com" }
+			path "/debian" { url = "https://deb.debian.org/debian" }
+		`, 2, true},
+		{"duplicate", `
+			path "/debian" { url = "https://deb.debian.org/debian" }
+			path "/debian" { url = "https://ftp.de.debian.org/debian" }
+		`, 0, false},
+		{"duplicate-slash", `
+			path "/debian" { url = "https://deb.debian.org/debian" }
+			path "/debian/" { url = "https://ftp.de.debian.org/debian" }
+		`, 0, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f, err := ioutil.TempFile("", "distriproxy-test-config-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				_ = os.Remove(f.Name())
+			}()
+
+			_, err = f.WriteString(test.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = f.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			cfg, err := ParseConfig(f.Name())
+			if !test.ok {
+				if err == nil {
+					t.Fatal("expected error not found")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(cfg.Paths) != test.paths {
+				t.Fatalf("wrong number of paths, want %d, got %d", test.paths, len(cfg.Paths))
+			}
+		})
+	}
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+func TestGetEndpoints(t *testing.T) {
+	var tests = []struct {
+		name string
+		cfg  Config
+		want []endpoint
+		ok   bool
+	}{
+		{"default", Config{TLSEnable: boolPtr(false)},
+			[]endpoint{{Address: defaultListenAddress}}, true},
+		{"listen", Config{Listen: stringPtr("unix:/run/distriproxy.sock"), TLSEnable: boolPtr(false)},
+			[]endpoint{{Address: "unix:/run/distriproxy.sock"}}, true},
+		{"listen-tls", Config{Listen: stringPtr(":8443"), TLSEnable: boolPtr(true)},
+			[]endpoint{{Address: ":8443", TLS: true}}, true},
+		{"listeners", Config{
+			TLSEnable:          boolPtr(false),
+			TLSCertificateFile: stringPtr("cert.pem"),
+			TLSKeyFile:         stringPtr("key.pem"),
+			Listeners: []Listener{
+				{Address: "tcp::80", RedirectHTTPS: boolPtr(true)},
+				{Address: ":443", TLS: boolPtr(true)},
+				{Address: "unix:/run/distriproxy.sock"},
+			},
+		}, []endpoint{
+			{Address: "tcp::80", RedirectHTTPS: true},
+			{Address: ":443", TLS: true},
+			{Address: "unix:/run/distriproxy.sock"},
+		}, true},
+		{"listeners-ignore-listen", Config{
+			Listen:    stringPtr(":8080"),
+			TLSEnable: boolPtr(true),
+			Listeners: []Listener{{Address: ":3142"}},
+		}, []endpoint{{Address: ":3142"}}, true},
+		{"tls-without-certificate", Config{
+			TLSEnable:  boolPtr(false),
+			TLSKeyFile: stringPtr("key.pem"),
+			Listeners:  []Listener{{Address: ":443", TLS: boolPtr(true)}},
+		}, nil, false},
+		{"tls-without-key", Config{
+			TLSEnable:          boolPtr(false),
+			TLSCertificateFile: stringPtr("cert.pem"),
+			Listeners:          []Listener{{Address: ":443", TLS: boolPtr(true)}},
+		}, nil, false},
+		{"redirect-with-tls", Config{
+			TLSEnable:          boolPtr(false),
+			TLSCertificateFile: stringPtr("cert.pem"),
+			TLSKeyFile:         stringPtr("key.pem"),
+			Listeners:          []Listener{{Address: ":443", TLS: boolPtr(true), RedirectHTTPS: boolPtr(true)}},
+		}, nil, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			endpoints, err := getEndpoints(test.cfg)
+			if !test.ok {
+				if err == nil {
+					t.Fatal("expected error not found")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(endpoints, test.want) {
+				t.Fatalf("wrong endpoints, want %+v, got %+v", test.want, endpoints)
+			}
+		})
+	}
+}
+
+func TestGetListeners(t *testing.T) {
+	inUse := listen(t, "tcp", "127.0.0.1:0")
+	defer func() {
+		_ = inUse.Close()
+	}()
+
+	var tests = []struct {
+		name             string
+		addresses        []string
+		socketActivation bool
+		activated        []net.Listener
+		activatedErr     error
+		listeners        int
+		systemd          bool
+		ok               bool
+	}{
+		{"disabled", []string{"127.0.0.1:0"}, false, nil, nil, 1, false, true},
+		{"none-passed", []string{"127.0.0.1:0", "127.0.0.1:0"}, true, nil, nil, 2, false, true},
+		{"activation-failed", []string{"127.0.0.1:0"}, true, nil, errors.New("no sockets passed in"), 1, false, true},
+		{"activated", []string{":80", ":443"}, true,
+			[]net.Listener{listen(t, "tcp", "127.0.0.1:0"), listen(t, "tcp", "127.0.0.1:0")}, nil, 2, true, true},
+		{"activated-wrong-number", []string{":80", ":443"}, true,
+			[]net.Listener{listen(t, "tcp", "127.0.0.1:0")}, nil, 0, false, false},
+		{"in-use", []string{"127.0.0.1:0", inUse.Addr().String()}, false, nil, nil, 0, false, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			activated := func() ([]net.Listener, error) {
+				if !test.socketActivation {
+					t.Fatal("socket activation used although disabled")
+				}
+				return test.activated, test.activatedErr
+			}
+
+			listeners, systemd, err := getListeners(test.addresses, 0, test.socketActivation, activated)
+			defer func() {
+				for _, l := range append(listeners, test.activated...) {
+					_ = l.Close()
+				}
+			}()
+
+			if !test.ok {
+				if err == nil {
+					t.Fatal("expected error not found")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(listeners) != test.listeners {
+				t.Fatalf("wrong number of listeners, want %d, got %d", test.listeners, len(listeners))
+			}
+
+			if systemd != test.systemd {
+				t.Fatalf("wrong systemd result, want %v, got %v", test.systemd, systemd)
+			}
+
+			if test.systemd && !reflect.DeepEqual(listeners, test.activated) {
+				t.Fatalf("activated listeners not used")
+			}
+		})
+	}
+}
+
+func TestParseListenAddress(t *testing.T) {
+	var tests = []struct {
+		address string
+		network string
+		addr    string
+	}{
+		{":8080", "tcp", ":8080"},
+		{"127.0.0.1:3142", "tcp", "127.0.0.1:3142"},
+		{"[::1]:3142", "tcp", "[::1]:3142"},
+		{"tcp::8080", "tcp", ":8080"},
+		{"tcp:127.0.0.1:3142", "tcp", "127.0.0.1:3142"},
+		{"unix:/run/distriproxy.sock", "unix", "/run/distriproxy.sock"},
+		{"unix:distriproxy.sock", "unix", "distriproxy.sock"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.address, func(t *testing.T) {
+			network, addr := parseListenAddress(test.address)
+			if network != test.network || addr != test.addr {
+				t.Fatalf("wrong result, want %v %v, got %v %v", test.network, test.addr, network, addr)
+			}
+		})
+	}
+}
+
+func TestHTTPSPort(t *testing.T) {
+	var tests = []struct {
+		name      string
+		endpoints []endpoint
+		port      string
+		ok        bool
+	}{
+		{"tls", []endpoint{
+			{Address: ":80", RedirectHTTPS: true},
+			{Address: ":443", TLS: true},
+		}, "443", true},
+		{"tcp-prefix", []endpoint{{Address: "tcp:127.0.0.1:8443", TLS: true}}, "8443", true},
+		{"first", []endpoint{
+			{Address: ":8443", TLS: true},
+			{Address: ":443", TLS: true},
+		}, "8443", true},
+		{"skip-unix", []endpoint{
+			{Address: "unix:/run/distriproxy.sock", TLS: true},
+			{Address: "[::1]:443", TLS: true},
+		}, "443", true},
+		{"no-tls", []endpoint{{Address: ":80", RedirectHTTPS: true}, {Address: ":8080"}}, "", false},
+		{"only-unix", []endpoint{{Address: "unix:/run/distriproxy.sock", TLS: true}}, "", false},
+		{"invalid", []endpoint{{Address: "localhost", TLS: true}}, "", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			port, err := httpsPort(test.endpoints)
+			if !test.ok {
+				if err == nil {
+					t.Fatal("expected error not found")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if port != test.port {
+				t.Fatalf("wrong port, want %q, got %q", test.port, port)
+			}
+		})
+	}
+}
+
+func TestListenOnUnix(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	filename := filepath.Join(dir, "distriproxy.sock")
+
+	// a socket file nobody accepts connections on any more is replaced
+	stale, err := net.Listen("unix", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	_ = stale.Close()
+
+	l, err := listenOn("unix:"+filename, 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = l.Close()
+	}()
+
+	fi, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fi.Mode().Perm() != 0660 {
+		t.Fatalf("wrong socket mode, want %v, got %v", os.FileMode(0660), fi.Mode().Perm())
+	}
+
+	// the socket is in use now
+	_, err = listenOn("unix:"+filename, 0)
+	if err == nil {
+		t.Fatal("expected error for socket in use not found")
+	}
+
+	// regular files are never removed
+	regular := filepath.Join(dir, "file")
+	err = ioutil.WriteFile(regular, []byte("data"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = listenOn("unix:"+regular, 0)
+	if err == nil {
+		t.Fatal("expected error for regular file not found")
+	}
+
+	if _, err = os.Stat(regular); err != nil {
+		t.Fatalf("regular file was removed: %v", err)
+	}
+}
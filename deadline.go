@@ -0,0 +1,19 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// LimitDuration passes requests to next with a context which is cancelled
+// after max, so that requests to the upstream servers are aborted. Writes to
+// slow clients are aborted by http.Server.WriteTimeout.
+func LimitDuration(next http.Handler, max time.Duration) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		ctx, cancel := context.WithTimeout(req.Context(), max)
+		defer cancel()
+
+		next.ServeHTTP(rw, req.WithContext(ctx))
+	})
+}
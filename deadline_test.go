@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a buffer which can be used as the log output while handlers
+// are running.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// captureLog redirects the log output to a buffer, the returned function
+// restores it.
+func captureLog() (*syncBuffer, func()) {
+	buf := &syncBuffer{}
+	log.SetOutput(buf)
+	return buf, func() {
+		log.SetOutput(os.Stderr)
+	}
+}
+
+// waitForLog waits until buf contains s, it fails the test after a timeout.
+func waitForLog(t *testing.T, buf *syncBuffer, s string) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(buf.String(), s) {
+		if time.Now().After(deadline) {
+			t.Fatalf("log does not contain %q:\n%s", s, buf.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLimitDuration(t *testing.T) {
+	// stalled is closed when the test ends, so that the upstream server can
+	// shut down
+	stalled := make(chan struct{})
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/slow-header" {
+			select {
+			case <-stalled:
+			case <-req.Context().Done():
+			}
+			return
+		}
+
+		rw.Header().Set("Content-Length", "100")
+		_, _ = rw.Write([]byte("0123456789"))
+		rw.(http.Flusher).Flush()
+
+		select {
+		case <-stalled:
+		case <-req.Context().Done():
+		}
+	}))
+	defer upstream.Close()
+	defer close(stalled)
+
+	buf, restore := captureLog()
+	defer restore()
+
+	proxy, err := NewProxy(Path{Path: "/debian", URL: upstream.URL}, nil, &Shared{LogLevel: LogInfo, LogSampleRate: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/debian/", proxy)
+
+	srv := httptest.NewServer(LimitDuration(mux, 100*time.Millisecond))
+	defer srv.Close()
+
+	t.Run("header", func(t *testing.T) {
+		start := time.Now()
+		res, body := get(t, srv.URL+"/debian/slow-header")
+		if res.StatusCode != http.StatusGatewayTimeout {
+			t.Errorf("wrong status, want %v, got %v", http.StatusGatewayTimeout, res.Status)
+		}
+
+		if body != "upstream server not available\n" {
+			t.Errorf("wrong body %q", body)
+		}
+
+		if d := time.Since(start); d > 2*time.Second {
+			t.Errorf("request was not aborted, took %v", d)
+		}
+
+		waitForLog(t, buf, "GET /slow-header upstream request aborted after")
+		waitForLog(t, buf, "max_request_duration exceeded")
+	})
+
+	t.Run("body", func(t *testing.T) {
+		start := time.Now()
+		res, err := http.Get(srv.URL + "/debian/slow-body")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("wrong status, want %v, got %v", http.StatusOK, res.Status)
+		}
+
+		// the response is cut short after the data sent so far
+		data, err := ioutil.ReadAll(res.Body)
+		_ = res.Body.Close()
+		if err == nil {
+			t.Errorf("reading the truncated body did not return an error")
+		}
+
+		if string(data) != "0123456789" {
+			t.Errorf("wrong data received: %q", data)
+		}
+
+		if d := time.Since(start); d > 2*time.Second {
+			t.Errorf("request was not aborted, took %v", d)
+		}
+
+		waitForLog(t, buf, "GET /slow-body aborted after 10 bytes, max_request_duration exceeded")
+	})
+}
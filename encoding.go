@@ -0,0 +1,79 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// acceptsEncoding reports whether the content coding is acceptable according
+// to the Accept-Encoding header. Without the header, only the identity coding
+// is accepted.
+func acceptsEncoding(header http.Header, coding string) bool {
+	wildcard := false
+	for _, value := range header["Accept-Encoding"] {
+		for _, item := range strings.Split(value, ",") {
+			params := strings.Split(item, ";")
+			name := strings.ToLower(strings.TrimSpace(params[0]))
+
+			q := 1.0
+			for _, param := range params[1:] {
+				param = strings.TrimSpace(param)
+				if strings.HasPrefix(param, "q=") {
+					v, err := strconv.ParseFloat(param[2:], 64)
+					if err == nil {
+						q = v
+					}
+				}
+			}
+
+			switch name {
+			case coding:
+				return q > 0
+			case "*":
+				wildcard = q > 0
+			}
+		}
+	}
+
+	return wildcard
+}
+
+// gzipReadCloser decompresses the body of an upstream response.
+type gzipReadCloser struct {
+	*gzip.Reader
+	body io.ReadCloser
+}
+
+func (r gzipReadCloser) Close() error {
+	_ = r.Reader.Close()
+	return r.body.Close()
+}
+
+// decodeUnacceptable decompresses the body of res if the upstream server
+// used gzip although it was not acceptable according to the request header.
+// It reports whether the body was decoded.
+func decodeUnacceptable(header http.Header, res *http.Response) (bool, error) {
+	coding := strings.ToLower(res.Header.Get("Content-Encoding"))
+	if coding != "gzip" && coding != "x-gzip" {
+		return false, nil
+	}
+
+	if acceptsEncoding(header, "gzip") || acceptsEncoding(header, coding) {
+		return false, nil
+	}
+
+	rd, err := gzip.NewReader(res.Body)
+	if err != nil {
+		return false, err
+	}
+
+	res.Body = gzipReadCloser{Reader: rd, body: res.Body}
+	res.Header.Del("Content-Encoding")
+	res.Header.Del("Content-Length")
+	res.ContentLength = -1
+
+	return true, nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func gzipData(t *testing.T, data string) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	wr := gzip.NewWriter(&buf)
+	_, err := wr.Write([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = wr.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestAcceptsEncoding(t *testing.T) {
+	var tests = []struct {
+		accept []string
+		coding string
+		ok     bool
+	}{
+		{nil, "gzip", false},
+		{[]string{"gzip"}, "gzip", true},
+		{[]string{"GZIP"}, "gzip", true},
+		{[]string{"deflate, gzip;q=0.5"}, "gzip", true},
+		{[]string{"deflate", "gzip"}, "gzip", true},
+		{[]string{"gzip;q=0"}, "gzip", false},
+		{[]string{"gzip; q=0.0"}, "gzip", false},
+		{[]string{"identity"}, "gzip", false},
+		{[]string{"br"}, "gzip", false},
+		{[]string{"*"}, "gzip", true},
+		{[]string{"*;q=0"}, "gzip", false},
+		{[]string{"*, gzip;q=0"}, "gzip", false},
+		{[]string{"gzip;q=0, *"}, "gzip", false},
+		{[]string{"x-gzip"}, "gzip", false},
+		{[]string{"x-gzip"}, "x-gzip", true},
+	}
+
+	for _, test := range tests {
+		header := http.Header{"Accept-Encoding": test.accept}
+		if acceptsEncoding(header, test.coding) != test.ok {
+			t.Errorf("wrong result for %q and %v, want %v", test.accept, test.coding, test.ok)
+		}
+	}
+}
+
+func TestProxyDecodeUnacceptable(t *testing.T) {
+	const data = "Package: foo\nVersion: 1.0\n\nPackage: bar\nVersion: 2.0\n"
+	compressed := gzipData(t, data)
+
+	// the upstream server uses gzip regardless of the request
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Encoding", "gzip")
+		rw.Header().Set("Content-Length", strconv.Itoa(len(compressed)))
+		_, _ = rw.Write(compressed)
+	}))
+	defer upstream.Close()
+
+	// send Accept-Encoding exactly as given in the test
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+
+	var tests = []struct {
+		name            string
+		accept          string
+		bufferThreshold int64
+		encoding        string
+		contentLength   int64
+		body            []byte
+	}{
+		{"gzip", "gzip", 0, "gzip", int64(len(compressed)), compressed},
+		{"gzip-q", "br;q=1.0, gzip;q=0.8", 0, "gzip", int64(len(compressed)), compressed},
+		{"none", "", 0, "", -1, []byte(data)},
+		{"identity", "identity", 0, "", -1, []byte(data)},
+		{"br", "br", 0, "", -1, []byte(data)},
+		{"gzip-refused", "gzip;q=0", 0, "", -1, []byte(data)},
+		{"buffered", "identity", 1 << 20, "", int64(len(data)), []byte(data)},
+		{"buffered-gzip", "gzip", 1 << 20, "gzip", int64(len(compressed)), compressed},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srv := newTestProxyShared(t, Path{Path: "/debian", URL: upstream.URL}, &Shared{LogLevel: LogError, BufferThreshold: test.bufferThreshold})
+			defer srv.Close()
+
+			req, err := http.NewRequest(http.MethodGet, srv.URL+"/debian/dists/buster/main/binary-amd64/Packages", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if test.accept != "" {
+				req.Header.Set("Accept-Encoding", test.accept)
+			}
+
+			res, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			body, err := ioutil.ReadAll(res.Body)
+			_ = res.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if res.Header.Get("Content-Encoding") != test.encoding {
+				t.Errorf("wrong Content-Encoding, want %q, got %q", test.encoding, res.Header.Get("Content-Encoding"))
+			}
+
+			if res.ContentLength != test.contentLength {
+				t.Errorf("wrong Content-Length, want %d, got %d", test.contentLength, res.ContentLength)
+			}
+
+			if !bytes.Equal(body, test.body) {
+				t.Errorf("wrong body, want %q, got %q", test.body, body)
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// executer is implemented by both text/template and html/template.
+type executer interface {
+	Execute(io.Writer, interface{}) error
+}
+
+type errorPage struct {
+	contentType string
+	tmpl        executer
+}
+
+// ErrorPages renders custom bodies for error responses generated by
+// distriproxy. A nil *ErrorPages sends the built-in minimal responses.
+type ErrorPages struct {
+	pages map[int]errorPage
+}
+
+// errorPageData is passed to the error page templates.
+type errorPageData struct {
+	Status     int
+	StatusText string
+	Method     string
+	Path       string
+}
+
+// LoadErrorPages parses the templates configured in the error_page blocks.
+// The Content-Type is guessed from the file extension, templates for HTML
+// files are escaped accordingly.
+func LoadErrorPages(cfg []ErrorPage) (*ErrorPages, error) {
+	e := &ErrorPages{
+		pages: make(map[int]errorPage),
+	}
+
+	for _, page := range cfg {
+		status, err := strconv.Atoi(page.Status)
+		if err != nil || status < 400 || status > 599 {
+			return nil, fmt.Errorf("error_page %q: invalid status code", page.Status)
+		}
+
+		buf, err := ioutil.ReadFile(page.Template)
+		if err != nil {
+			return nil, fmt.Errorf("error_page %q: %v", page.Status, err)
+		}
+
+		contentType := mime.TypeByExtension(filepath.Ext(page.Template))
+		if contentType == "" {
+			contentType = "text/plain; charset=utf-8"
+		}
+
+		var tmpl executer
+		if strings.HasPrefix(contentType, "text/html") {
+			tmpl, err = htmltemplate.New(page.Template).Parse(string(buf))
+		} else {
+			tmpl, err = template.New(page.Template).Parse(string(buf))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error_page %q: %v", page.Status, err)
+		}
+
+		e.pages[status] = errorPage{
+			contentType: contentType,
+			tmpl:        tmpl,
+		}
+	}
+
+	return e, nil
+}
+
+// WriteError sends the status code to the client together with the configured
+// error page. When no page is configured for the status, the body is fallback
+// (which may be empty).
+func (e *ErrorPages) WriteError(rw http.ResponseWriter, req *http.Request, status int, fallback string) {
+	var page errorPage
+	var ok bool
+	if e != nil {
+		page, ok = e.pages[status]
+	}
+
+	if !ok {
+		rw.WriteHeader(status)
+		if fallback != "" {
+			_, _ = io.WriteString(rw, fallback)
+		}
+		return
+	}
+
+	// use the path as requested by the client, handlers like
+	// http.StripPrefix modify req.URL
+	path := req.URL.Path
+	if u, err := url.ParseRequestURI(req.RequestURI); err == nil {
+		path = u.Path
+	}
+
+	data := errorPageData{
+		Status:     status,
+		StatusText: http.StatusText(status),
+		Method:     req.Method,
+		Path:       path,
+	}
+
+	var buf bytes.Buffer
+	err := page.tmpl.Execute(&buf, data)
+	if err != nil {
+		log.Printf("rendering error page for %v failed: %v", status, err)
+		rw.WriteHeader(status)
+		return
+	}
+
+	rw.Header().Set("Content-Type", page.contentType)
+	rw.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	rw.WriteHeader(status)
+	_, _ = buf.WriteTo(rw)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// proxyError is an error which is answered by distriproxy itself with an
+// HTTP status code. The log message may contain internal details, the
+// client only sees the status and a short message.
+type proxyError struct {
+	Status  int
+	Level   LogLevel
+	Log     string
+	Message string
+}
+
+func (e *proxyError) Error() string {
+	return e.Log
+}
+
+// newProxyError returns a proxyError with the given status and client
+// message. The log message is formatted according to format.
+func newProxyError(status int, message string, level LogLevel, format string, args ...interface{}) *proxyError {
+	return &proxyError{
+		Status:  status,
+		Level:   level,
+		Log:     fmt.Sprintf(format, args...),
+		Message: message,
+	}
+}
+
+// errors returned by the proxy handlers
+func errBadRequest(format string, args ...interface{}) *proxyError {
+	return newProxyError(http.StatusBadRequest, "bad request\n", LogWarn, format, args...)
+}
+
+func errUnauthorized(format string, args ...interface{}) *proxyError {
+	return newProxyError(http.StatusUnauthorized, "unauthorized\n", LogWarn, format, args...)
+}
+
+func errForbidden(format string, args ...interface{}) *proxyError {
+	return newProxyError(http.StatusForbidden, "forbidden\n", LogWarn, format, args...)
+}
+
+func errNotFound(format string, args ...interface{}) *proxyError {
+	return newProxyError(http.StatusNotFound, "not found\n", LogInfo, format, args...)
+}
+
+func errMethodNotAllowed(format string, args ...interface{}) *proxyError {
+	return newProxyError(http.StatusMethodNotAllowed, "method not allowed\n", LogWarn, format, args...)
+}
+
+func errProxyAuthRequired(format string, args ...interface{}) *proxyError {
+	return newProxyError(http.StatusProxyAuthRequired, "proxy authentication required\n", LogWarn, format, args...)
+}
+
+func errTooManyRequests(format string, args ...interface{}) *proxyError {
+	return newProxyError(http.StatusTooManyRequests, "too many requests, try again later\n", LogWarn, format, args...)
+}
+
+func errHeaderTooLarge(format string, args ...interface{}) *proxyError {
+	return newProxyError(http.StatusRequestHeaderFieldsTooLarge, "request header fields too large\n", LogWarn, format, args...)
+}
+
+func errLoopDetected(format string, args ...interface{}) *proxyError {
+	return newProxyError(http.StatusLoopDetected, "loop detected\n", LogError, format, args...)
+}
+
+func errInternal(format string, args ...interface{}) *proxyError {
+	return newProxyError(http.StatusInternalServerError, "internal server error\n", LogError, format, args...)
+}
+
+func errBadGateway(format string, args ...interface{}) *proxyError {
+	return newProxyError(http.StatusBadGateway, "upstream server failed\n", LogError, format, args...)
+}
+
+func errUnavailable(format string, args ...interface{}) *proxyError {
+	return newProxyError(http.StatusServiceUnavailable, "service unavailable, try again later\n", LogWarn, format, args...)
+}
+
+func errGatewayTimeout(format string, args ...interface{}) *proxyError {
+	return newProxyError(http.StatusGatewayTimeout, "upstream server not available\n", LogInfo, format, args...)
+}
+
+// writeError logs e with the prefix and sends the error response (or the
+// configured error page) to the client.
+func (s *Shared) writeError(rw http.ResponseWriter, req *http.Request, prefix string, e *proxyError) {
+	s.logf(e.Level, "%v%v", prefix, e.Log)
+	setServer(rw.Header())
+	s.ErrorPages.WriteError(rw, req, e.Status, e.Message)
+}
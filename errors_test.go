@@ -0,0 +1,237 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+)
+
+func TestWriteError(t *testing.T) {
+	var tests = []struct {
+		err    *proxyError
+		status int
+		body   string
+		level  LogLevel
+	}{
+		{errBadRequest("x"), http.StatusBadRequest, "bad request\n", LogWarn},
+		{errUnauthorized("x"), http.StatusUnauthorized, "unauthorized\n", LogWarn},
+		{errForbidden("x"), http.StatusForbidden, "forbidden\n", LogWarn},
+		{errNotFound("x"), http.StatusNotFound, "not found\n", LogInfo},
+		{errMethodNotAllowed("x"), http.StatusMethodNotAllowed, "method not allowed\n", LogWarn},
+		{errProxyAuthRequired("x"), http.StatusProxyAuthRequired, "proxy authentication required\n", LogWarn},
+		{errTooManyRequests("x"), http.StatusTooManyRequests, "too many requests, try again later\n", LogWarn},
+		{errHeaderTooLarge("x"), http.StatusRequestHeaderFieldsTooLarge, "request header fields too large\n", LogWarn},
+		{errLoopDetected("x"), http.StatusLoopDetected, "loop detected\n", LogError},
+		{errInternal("x"), http.StatusInternalServerError, "internal server error\n", LogError},
+		{errBadGateway("x"), http.StatusBadGateway, "upstream server failed\n", LogError},
+		{errUnavailable("x"), http.StatusServiceUnavailable, "service unavailable, try again later\n", LogWarn},
+		{errGatewayTimeout("x"), http.StatusGatewayTimeout, "upstream server not available\n", LogInfo},
+	}
+
+	shared := &Shared{LogLevel: LogError - 1}
+	for _, test := range tests {
+		t.Run(http.StatusText(test.status), func(t *testing.T) {
+			if test.err.Level != test.level {
+				t.Errorf("wrong log level, want %v, got %v", test.level, test.err.Level)
+			}
+
+			rec := httptest.NewRecorder()
+			shared.writeError(rec, httptest.NewRequest(http.MethodGet, "/debian/x", nil), "", test.err)
+
+			if rec.Code != test.status {
+				t.Errorf("wrong status, want %v, got %v", test.status, rec.Code)
+			}
+
+			if rec.Body.String() != test.body {
+				t.Errorf("wrong body, want %q, got %q", test.body, rec.Body.String())
+			}
+
+			if rec.Header().Get("Server") == "" {
+				t.Errorf("Server header not set")
+			}
+		})
+	}
+}
+
+func TestWriteErrorPage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "distriproxy-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	filename := filepath.Join(dir, "403.html")
+	err = ioutil.WriteFile(filename, []byte("<p>{{.Status}} {{.StatusText}}: {{.Method}} {{.Path}}</p>"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pages, err := LoadErrorPages([]ErrorPage{{Status: "403", Template: filename}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shared := &Shared{LogLevel: LogError - 1, ErrorPages: pages}
+
+	var tests = []struct {
+		err         *proxyError
+		status      int
+		contentType string
+		body        string
+	}{
+		{errForbidden("x"), http.StatusForbidden, "text/html; charset=utf-8", "<p>403 Forbidden: GET /debian/&lt;x&gt;</p>"},
+		{errNotFound("x"), http.StatusNotFound, "", "not found\n"},
+	}
+
+	for _, test := range tests {
+		t.Run(http.StatusText(test.status), func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			shared.writeError(rec, httptest.NewRequest(http.MethodGet, "/debian/%3cx%3e", nil), "", test.err)
+
+			if rec.Code != test.status {
+				t.Errorf("wrong status, want %v, got %v", test.status, rec.Code)
+			}
+
+			if rec.Header().Get("Content-Type") != test.contentType {
+				t.Errorf("wrong Content-Type, want %q, got %q", test.contentType, rec.Header().Get("Content-Type"))
+			}
+
+			if rec.Body.String() != test.body {
+				t.Errorf("wrong body, want %q, got %q", test.body, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestRejectProxyRequests(t *testing.T) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte("next\n"))
+	})
+	forward := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte("forward\n"))
+	})
+
+	var tests = []struct {
+		name    string
+		forward http.Handler
+		method  string
+		target  string
+		status  int
+		body    string
+		allow   string
+	}{
+		{"get", nil, http.MethodGet, "/debian/x", http.StatusOK, "next\n", ""},
+		{"head", nil, http.MethodHead, "/debian/x", http.StatusOK, "next\n", ""},
+		{"post", nil, http.MethodPost, "/debian/x", http.StatusMethodNotAllowed, "method not allowed\n", "GET, HEAD"},
+		{"proxy", nil, http.MethodGet, "http://example.com/debian/x", http.StatusBadRequest, "this is not a proxy\n", ""},
+		{"forward", forward, http.MethodGet, "http://example.com/debian/x", http.StatusOK, "forward\n", ""},
+		{"forward-post", forward, http.MethodPost, "http://example.com/debian/x", http.StatusMethodNotAllowed, "method not allowed\n", "GET, HEAD"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handler := RejectProxyRequests(next, test.forward, defaultAllowedMethods, &Shared{LogLevel: LogError})
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(test.method, test.target, nil))
+
+			if rec.Code != test.status {
+				t.Errorf("wrong status, want %v, got %v", test.status, rec.Code)
+			}
+
+			if rec.Body.String() != test.body {
+				t.Errorf("wrong body, want %q, got %q", test.body, rec.Body.String())
+			}
+
+			if rec.Header().Get("Allow") != test.allow {
+				t.Errorf("wrong Allow header, want %q, got %q", test.allow, rec.Header().Get("Allow"))
+			}
+		})
+	}
+}
+
+func TestRejectProxyRequestsMethods(t *testing.T) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte("next\n"))
+	})
+
+	methods := []string{http.MethodGet, http.MethodHead, http.MethodOptions}
+	handler := RejectProxyRequests(next, nil, methods, &Shared{LogLevel: LogError})
+
+	var tests = []struct {
+		method string
+		status int
+		allow  string
+	}{
+		{http.MethodGet, http.StatusOK, ""},
+		{http.MethodHead, http.StatusOK, ""},
+		{http.MethodOptions, http.StatusOK, ""},
+		{http.MethodPost, http.StatusMethodNotAllowed, "GET, HEAD, OPTIONS"},
+		{http.MethodPut, http.StatusMethodNotAllowed, "GET, HEAD, OPTIONS"},
+		{http.MethodDelete, http.StatusMethodNotAllowed, "GET, HEAD, OPTIONS"},
+		{"get", http.StatusMethodNotAllowed, "GET, HEAD, OPTIONS"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.method, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(test.method, "/debian/x", nil))
+
+			if rec.Code != test.status {
+				t.Errorf("wrong status, want %v, got %v", test.status, rec.Code)
+			}
+
+			if rec.Header().Get("Allow") != test.allow {
+				t.Errorf("wrong Allow header, want %q, got %q", test.allow, rec.Header().Get("Allow"))
+			}
+		})
+	}
+}
+
+func TestRobots(t *testing.T) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte("next\n"))
+	})
+
+	handler := Robots(next, []byte(defaultRobotsTxt), regexp.MustCompile("(?i)badbot"), &Shared{LogLevel: LogError})
+
+	var tests = []struct {
+		name      string
+		method    string
+		target    string
+		userAgent string
+		status    int
+		body      string
+	}{
+		{"robots", http.MethodGet, "/robots.txt", "apt", http.StatusOK, defaultRobotsTxt},
+		{"robots-head", http.MethodHead, "/robots.txt", "apt", http.StatusOK, ""},
+		{"robots-bot", http.MethodGet, "/robots.txt", "BadBot/1.0", http.StatusOK, defaultRobotsTxt},
+		{"robots-proxy", http.MethodGet, "http://example.com/robots.txt", "apt", http.StatusOK, "next\n"},
+		{"bot", http.MethodGet, "/debian/x", "BadBot/1.0", http.StatusForbidden, "forbidden\n"},
+		{"client", http.MethodGet, "/debian/x", "apt", http.StatusOK, "next\n"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(test.method, test.target, nil)
+			req.Header.Set("User-Agent", test.userAgent)
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != test.status {
+				t.Errorf("wrong status, want %v, got %v", test.status, rec.Code)
+			}
+
+			if rec.Body.String() != test.body {
+				t.Errorf("wrong body, want %q, got %q", test.body, rec.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// ForwardProxy handles requests sent to distriproxy as an HTTP proxy (e.g. via
+// apt's http_proxy setting), which carry an absolute URL. Requests for the
+// upstream of a configured path are routed to the handler for that path,
+// other requests are forwarded to the requested host if it is on the
+// allowlist. If Auth is set, clients must authenticate with the
+// Proxy-Authorization header, except for routes to paths which do not require
+// authentication.
+type ForwardProxy struct {
+	Client *http.Client
+	Hosts  map[string]struct{}
+	Auth   *Authenticator
+
+	routes []forwardRoute
+
+	*Shared
+}
+
+// forwardRoute maps requests for an upstream URL to a configured path.
+type forwardRoute struct {
+	host        string
+	path        string
+	prefix      string
+	handler     http.Handler
+	requireAuth bool
+}
+
+// NewForwardProxy returns a forward proxy for the host names in hosts, auth
+// may be nil.
+func NewForwardProxy(hosts []string, client *http.Client, auth *Authenticator, shared *Shared) *ForwardProxy {
+	f := &ForwardProxy{
+		Client: client,
+		Hosts:  make(map[string]struct{}, len(hosts)),
+		Auth:   auth,
+		Shared: shared,
+	}
+
+	for _, host := range hosts {
+		f.Hosts[strings.ToLower(host)] = struct{}{}
+	}
+
+	return f
+}
+
+// AddRoute passes proxy requests for URLs below upstream to handler, which
+// is responsible for the path prefix. The handler must not check credentials
+// itself, this is done by the forward proxy if requireAuth is set. Routes
+// with longer upstream paths take precedence.
+func (f *ForwardProxy) AddRoute(upstream, prefix string, handler http.Handler, requireAuth bool) error {
+	u, err := url.Parse(upstream)
+	if err != nil {
+		return err
+	}
+
+	f.routes = append(f.routes, forwardRoute{
+		host:        strings.ToLower(u.Host),
+		path:        strings.TrimRight(u.Path, "/"),
+		prefix:      prefix,
+		handler:     handler,
+		requireAuth: requireAuth,
+	})
+
+	sort.SliceStable(f.routes, func(i, j int) bool {
+		return len(f.routes[i].path) > len(f.routes[j].path)
+	})
+
+	return nil
+}
+
+// route returns the route and the local path for a proxy request matching one
+// of the routes.
+func (f *ForwardProxy) route(req *http.Request) (forwardRoute, string, bool) {
+	host := strings.ToLower(req.URL.Host)
+	for _, route := range f.routes {
+		if route.host != host {
+			continue
+		}
+
+		p := req.URL.Path
+		if p != route.path && !strings.HasPrefix(p, route.path+"/") {
+			continue
+		}
+
+		return route, route.prefix + strings.TrimPrefix(p, route.path), true
+	}
+
+	return forwardRoute{}, "", false
+}
+
+func (f *ForwardProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	// requests for a configured upstream are handled like a request for
+	// the path
+	if route, localPath, ok := f.route(req); ok {
+		if f.Auth != nil && route.requireAuth {
+			req, ok = f.Auth.authorizeProxy(rw, req, localPath, f.Shared)
+			if !ok {
+				return
+			}
+		}
+
+		r := new(http.Request)
+		*r = *req
+		r.URL = &url.URL{Path: localPath, RawQuery: req.URL.RawQuery}
+		route.handler.ServeHTTP(rw, r)
+		return
+	}
+
+	if f.Auth != nil {
+		u := *req.URL
+		u.RawQuery = ""
+
+		var ok bool
+		req, ok = f.Auth.authorizeProxy(rw, req, u.String(), f.Shared)
+		if !ok {
+			return
+		}
+	}
+
+	host := strings.ToLower(req.URL.Hostname())
+	if _, ok := f.Hosts[host]; !ok {
+		f.writeError(rw, req, "", errForbidden("%v reject proxy request for %v: host not allowed", clientIP(req), req.URL))
+		return
+	}
+
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		f.writeError(rw, req, "", errBadRequest("%v reject proxy request for %v: invalid scheme", clientIP(req), req.URL))
+		return
+	}
+
+	// handle the request like a configured path for this host, the
+	// query string is part of the requested URL
+	source := req.URL.Scheme + "://" + req.URL.Host
+	p := &Proxy{
+		Name:   source,
+		Source: source,
+		Client: f.Client,
+		host:   req.URL.Host,
+		Shared: f.Shared,
+
+		forwardQuery: true,
+	}
+
+	p.ServeHTTP(rw, req)
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// echoRequest returns a server which answers with the method, the request
+// URI and the Host header it has received.
+func echoRequest() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(rw, "%v %v %v", req.Method, req.RequestURI, req.Host)
+	}))
+}
+
+// newForwardTestServer returns a server which accepts proxy requests and
+// passes them to forward, and a client using it as the proxy.
+func newForwardTestServer(t *testing.T, forward http.Handler, shared *Shared) (*httptest.Server, *http.Client) {
+	t.Helper()
+
+	srv := httptest.NewServer(RejectProxyRequests(http.NotFoundHandler(), forward, defaultAllowedMethods, shared))
+
+	proxyURL, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	return srv, client
+}
+
+func TestForwardProxyHosts(t *testing.T) {
+	upstream := echoRequest()
+	defer upstream.Close()
+
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shared := &Shared{LogLevel: LogError}
+	forward := NewForwardProxy([]string{"EXAMPLE.com", u.Hostname()}, http.DefaultClient, nil, shared)
+
+	srv, client := newForwardTestServer(t, forward, shared)
+	defer srv.Close()
+
+	// the upstream server is also reachable as localhost, which is not on
+	// the allowlist
+	denied := "http://localhost:" + u.Port()
+
+	var tests = []struct {
+		name   string
+		method string
+		url    string
+		status int
+		body   string
+	}{
+		{"get", http.MethodGet, upstream.URL + "/debian/pool/x.deb", http.StatusOK,
+			"GET /debian/pool/x.deb " + u.Host},
+		{"query", http.MethodGet, upstream.URL + "/repo/x.rpm?b=2&a=1&c=%2F", http.StatusOK,
+			"GET /repo/x.rpm?b=2&a=1&c=%2F " + u.Host},
+		{"escaped", http.MethodGet, upstream.URL + "/pool/libc%2B%2B.deb", http.StatusOK,
+			"GET /pool/libc%2B%2B.deb " + u.Host},
+		{"escaped-slash", http.MethodGet, upstream.URL + "/pool/a%2Fb.deb", http.StatusOK,
+			"GET /pool/a%2Fb.deb " + u.Host},
+		{"cleaned", http.MethodGet, upstream.URL + "/pool//./x%2B.deb", http.StatusOK,
+			"GET /pool/x+.deb " + u.Host},
+		{"head", http.MethodHead, upstream.URL + "/debian/pool/x.deb", http.StatusOK, ""},
+		{"post", http.MethodPost, upstream.URL + "/debian/pool/x.deb", http.StatusMethodNotAllowed, "method not allowed\n"},
+		{"denied", http.MethodGet, denied + "/debian/pool/x.deb", http.StatusForbidden, "forbidden\n"},
+		{"dot-dot", http.MethodGet, upstream.URL + "/debian/%2e%2e/etc/passwd", http.StatusBadRequest, "bad request\n"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req, err := http.NewRequest(test.method, test.url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			res, body := do(t, client, req)
+			if res.StatusCode != test.status {
+				t.Fatalf("wrong status, want %v, got %v", test.status, res.StatusCode)
+			}
+
+			if body != test.body {
+				t.Fatalf("wrong body, want %q, got %q", test.body, body)
+			}
+		})
+	}
+}
+
+func TestForwardProxyScheme(t *testing.T) {
+	shared := &Shared{LogLevel: LogError}
+	forward := NewForwardProxy([]string{"example.com"}, http.DefaultClient, nil, shared)
+
+	rec := httptest.NewRecorder()
+	forward.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "ftp://example.com/debian/x.deb", nil))
+
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("wrong status, want %v, got %v", http.StatusBadRequest, rec.Code)
+	}
+}
+
+func TestForwardProxyConnect(t *testing.T) {
+	upstream := echoRequest()
+	defer upstream.Close()
+
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shared := &Shared{LogLevel: LogError}
+	forward := NewForwardProxy([]string{u.Hostname()}, http.DefaultClient, nil, shared)
+
+	srv, _ := newForwardTestServer(t, forward, shared)
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	// tunnels are not supported, even for allowed hosts
+	_, err = fmt.Fprintf(conn, "CONNECT %v HTTP/1.1\r\nHost: %v\r\n\r\n", u.Host, u.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = res.Body.Close()
+
+	if res.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("wrong status, want %v, got %v", http.StatusMethodNotAllowed, res.StatusCode)
+	}
+}
+
+func TestForwardProxyRoute(t *testing.T) {
+	forward := NewForwardProxy(nil, http.DefaultClient, nil, &Shared{LogLevel: LogError})
+
+	for _, route := range []struct {
+		upstream string
+		prefix   string
+	}{
+		{"http://deb.example.com/debian", "/debian"},
+		{"http://deb.example.com/debian-security/", "/debian-security"},
+		{"http://ftp.example.com/pub/ubuntu", "/ubuntu"},
+		{"http://ftp.example.com/pub/ubuntu/ports", "/ubuntu-ports"},
+		{"https://mirror.example.com", "/mirror"},
+	} {
+		err := forward.AddRoute(route.upstream, route.prefix, http.NotFoundHandler(), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var tests = []struct {
+		url  string
+		path string
+		ok   bool
+	}{
+		{"http://deb.example.com/debian/pool/x.deb", "/debian/pool/x.deb", true},
+		{"http://deb.example.com/debian/", "/debian/", true},
+		{"http://deb.example.com/debian", "/debian", true},
+		{"http://DEB.example.COM/debian/pool/x.deb", "/debian/pool/x.deb", true},
+		{"http://deb.example.com/debianx/pool/x.deb", "", false},
+		{"http://deb.example.com/debian-security/pool/x.deb", "/debian-security/pool/x.deb", true},
+		{"http://deb.example.com/debian-securityx/x.deb", "", false},
+		{"http://deb.example.com/", "", false},
+		{"http://deb.example.com:8080/debian/pool/x.deb", "", false},
+		{"http://other.example.com/debian/pool/x.deb", "", false},
+		{"http://ftp.example.com/pub/ubuntu/pool/x.deb", "/ubuntu/pool/x.deb", true},
+		{"http://ftp.example.com/pub/ubuntu/ports/pool/x.deb", "/ubuntu-ports/pool/x.deb", true},
+		{"http://ftp.example.com/pub/ubuntu/portsx/x.deb", "/ubuntu/portsx/x.deb", true},
+		{"http://ftp.example.com/pub/x.deb", "", false},
+		{"https://mirror.example.com/centos/x.rpm", "/mirror/centos/x.rpm", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.url, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, test.url, nil)
+
+			_, path, ok := forward.route(req)
+			if ok != test.ok {
+				t.Fatalf("wrong result, want %v, got %v", test.ok, ok)
+			}
+
+			if path != test.path {
+				t.Fatalf("wrong local path, want %q, got %q", test.path, path)
+			}
+		})
+	}
+}
+
+func TestForwardProxyModes(t *testing.T) {
+	upstream := echoRequest()
+	defer upstream.Close()
+
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shared := &Shared{LogLevel: LogError}
+	proxy, err := NewProxy(Path{Path: "/debian", URL: upstream.URL + "/mirror/debian"}, nil, shared)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/debian/", proxy)
+
+	forward := NewForwardProxy(nil, http.DefaultClient, nil, shared)
+	err = forward.AddRoute(upstream.URL+"/mirror/debian", "/debian", proxy, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name    string
+		forward http.Handler
+		target  string
+		status  int
+		body    string
+	}{
+		{"enabled-path", forward, "/debian/pool/x.deb", http.StatusOK,
+			"GET /mirror/debian/pool/x.deb " + u.Host},
+		{"enabled-route", forward, upstream.URL + "/mirror/debian/pool/x.deb", http.StatusOK,
+			"GET /mirror/debian/pool/x.deb " + u.Host},
+		{"enabled-route-query", forward, upstream.URL + "/mirror/debian/pool/x.deb?a=1", http.StatusOK,
+			"GET /mirror/debian/pool/x.deb " + u.Host},
+		{"enabled-prefix", forward, upstream.URL + "/mirror/debianx/pool/x.deb", http.StatusForbidden, "forbidden\n"},
+		{"enabled-other", forward, upstream.URL + "/other/x.deb", http.StatusForbidden, "forbidden\n"},
+		{"disabled-path", nil, "/debian/pool/x.deb", http.StatusOK,
+			"GET /mirror/debian/pool/x.deb " + u.Host},
+		{"disabled-route", nil, upstream.URL + "/mirror/debian/pool/x.deb", http.StatusBadRequest, "this is not a proxy\n"},
+		{"disabled-other", nil, upstream.URL + "/other/x.deb", http.StatusBadRequest, "this is not a proxy\n"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srv := httptest.NewServer(RejectProxyRequests(mux, test.forward, defaultAllowedMethods, shared))
+			defer srv.Close()
+
+			proxyURL, err := url.Parse(srv.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			target := test.target
+			client := http.DefaultClient
+			if u, err := url.Parse(target); err == nil && u.Host != "" {
+				// send an absolute URL to the server as a proxy
+				client = &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+			} else {
+				target = srv.URL + target
+			}
+
+			req, err := http.NewRequest(http.MethodGet, target, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			res, body := do(t, client, req)
+			if res.StatusCode != test.status {
+				t.Fatalf("wrong status, want %v, got %v", test.status, res.StatusCode)
+			}
+
+			if body != test.body {
+				t.Fatalf("wrong body, want %q, got %q", test.body, body)
+			}
+		})
+	}
+}
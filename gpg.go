@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/clearsign"
+	"golang.org/x/net/context/ctxhttp"
+)
+
+// maxSignedSize limits the size of signed metadata files which are read into
+// memory for verification.
+const maxSignedSize = 32 << 20
+
+// isSignedMetadata reports whether the file at p is signed repository
+// metadata which can be verified: Debian's InRelease files (clearsigned), or
+// Release files together with the detached signature in Release.gpg.
+func isSignedMetadata(p string) bool {
+	switch path.Base(p) {
+	case "InRelease", "Release", "Release.gpg":
+		return true
+	}
+	return false
+}
+
+// loadKeyring reads an OpenPGP keyring (e.g. exported with `gpg --export`),
+// both binary and ASCII armored files are accepted.
+func loadKeyring(filename string) (openpgp.EntityList, error) {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var keyring openpgp.EntityList
+	if bytes.HasPrefix(bytes.TrimSpace(buf), []byte("-----BEGIN")) {
+		keyring, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(buf))
+	} else {
+		keyring, err = openpgp.ReadKeyRing(bytes.NewReader(buf))
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("reading keyring %v failed: %v", filename, err)
+	}
+
+	if len(keyring) == 0 {
+		return nil, fmt.Errorf("keyring %v does not contain any keys", filename)
+	}
+
+	return keyring, nil
+}
+
+// readLimited reads all data from rd, up to maxSignedSize bytes.
+func readLimited(rd io.Reader) ([]byte, error) {
+	buf, err := ioutil.ReadAll(io.LimitReader(rd, maxSignedSize+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(buf) > maxSignedSize {
+		return nil, fmt.Errorf("file is larger than %d bytes", maxSignedSize)
+	}
+
+	return buf, nil
+}
+
+// clearsignHeader starts a clearsigned message.
+var clearsignHeader = []byte("-----BEGIN PGP SIGNED MESSAGE-----")
+
+// checkClearsigned returns the signer of the clearsigned message buf if the
+// signature was made by one of the keys in keyring. Since the whole file is
+// passed on to the client, data outside of the signed message (other than
+// white space) is rejected.
+func checkClearsigned(keyring openpgp.EntityList, buf []byte) (*openpgp.Entity, error) {
+	if !bytes.HasPrefix(bytes.TrimSpace(buf), clearsignHeader) {
+		return nil, errors.New("data before the clearsigned message")
+	}
+
+	block, rest := clearsign.Decode(buf)
+	if block == nil {
+		return nil, errors.New("no clearsigned message found")
+	}
+
+	if len(bytes.TrimSpace(rest)) != 0 {
+		return nil, errors.New("data after the clearsigned message")
+	}
+
+	return openpgp.CheckDetachedSignature(keyring, bytes.NewReader(block.Bytes), block.ArmoredSignature.Body)
+}
+
+// checkDetached returns the signer of the detached signature sig for signed
+// if the signature was made by one of the keys in keyring. The signature may
+// be ASCII armored.
+func checkDetached(keyring openpgp.EntityList, signed, sig []byte) (*openpgp.Entity, error) {
+	if bytes.HasPrefix(bytes.TrimSpace(sig), []byte("-----BEGIN")) {
+		return openpgp.CheckArmoredDetachedSignature(keyring, bytes.NewReader(signed), bytes.NewReader(sig))
+	}
+	return openpgp.CheckDetachedSignature(keyring, bytes.NewReader(signed), bytes.NewReader(sig))
+}
+
+// fetchCompanion requests the file at upstreamURL which is needed to verify a
+// detached signature.
+func (p *Proxy) fetchCompanion(ctx context.Context, upstreamURL string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, upstreamURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("User-Agent", p.UserAgent)
+
+	if p.authorization != "" {
+		req.Header.Set("Authorization", p.authorization)
+	}
+
+	res, err := ctxhttp.Do(ctx, p.Client, req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		_ = res.Body.Close()
+	}()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %v returned %v", path.Base(upstreamURL), res.Status)
+	}
+
+	_, err = decodeUnacceptable(req.Header, res)
+	if err != nil {
+		return nil, err
+	}
+
+	return readLimited(res.Body)
+}
+
+// verifySignature checks the signature of the metadata file at upstreamURL
+// with the content buf. For Release and Release.gpg, the respective other
+// file is fetched from the upstream server.
+func (p *Proxy) verifySignature(ctx context.Context, upstreamURL string, buf []byte) (*openpgp.Entity, error) {
+	switch path.Base(upstreamURL) {
+	case "InRelease":
+		return checkClearsigned(p.Keyring, buf)
+	case "Release":
+		sig, err := p.fetchCompanion(ctx, upstreamURL+".gpg")
+		if err != nil {
+			return nil, err
+		}
+		return checkDetached(p.Keyring, buf, sig)
+	case "Release.gpg":
+		signed, err := p.fetchCompanion(ctx, strings.TrimSuffix(upstreamURL, ".gpg"))
+		if err != nil {
+			return nil, err
+		}
+		return checkDetached(p.Keyring, signed, buf)
+	}
+
+	return nil, errors.New("not a signed metadata file")
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/clearsign"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+const testRelease = "Origin: Debian\nSuite: stable\nCodename: buster\n"
+
+// newTestKey returns a new key pair for signing test data.
+func newTestKey(t *testing.T, name string) *openpgp.Entity {
+	t.Helper()
+
+	key, err := openpgp.NewEntity(name, "", name+"@example.com", &packet.Config{RSABits: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+func clearsignData(t *testing.T, key *openpgp.Entity, data string) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	wr, err := clearsign.Encode(&buf, key.PrivateKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = wr.Write([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = wr.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func detachSign(t *testing.T, key *openpgp.Entity, data string, armored bool) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	var err error
+	if armored {
+		err = openpgp.ArmoredDetachSign(&buf, key, bytes.NewReader([]byte(data)), nil)
+	} else {
+		err = openpgp.DetachSign(&buf, key, bytes.NewReader([]byte(data)), nil)
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+// writeKeyring saves the public key in a temporary file and returns the
+// file name.
+func writeKeyring(t *testing.T, key *openpgp.Entity) string {
+	t.Helper()
+
+	f, err := ioutil.TempFile("", "distriproxy-test-keyring-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = key.Serialize(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return f.Name()
+}
+
+func TestIsSignedMetadata(t *testing.T) {
+	var tests = []struct {
+		path   string
+		signed bool
+	}{
+		{"/dists/buster/InRelease", true},
+		{"/dists/buster/Release", true},
+		{"/dists/buster/Release.gpg", true},
+		{"/dists/buster/main/binary-amd64/Packages", false},
+		{"/dists/buster/main/binary-amd64/Release.gz", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			if isSignedMetadata(test.path) != test.signed {
+				t.Fatalf("wrong result for %v, want %v", test.path, test.signed)
+			}
+		})
+	}
+}
+
+func TestCheckClearsigned(t *testing.T) {
+	key := newTestKey(t, "archive")
+	other := newTestKey(t, "other")
+
+	signed := clearsignData(t, key, testRelease)
+
+	var tests = []struct {
+		name    string
+		keyring openpgp.EntityList
+		data    []byte
+		ok      bool
+	}{
+		{"valid", openpgp.EntityList{key}, signed, true},
+		{"second-key", openpgp.EntityList{other, key}, signed, true},
+		{"wrong-key", openpgp.EntityList{other}, signed, false},
+		{"modified", openpgp.EntityList{key}, bytes.Replace(signed, []byte("stable"), []byte("sneaky"), 1), false},
+		{"not-signed", openpgp.EntityList{key}, []byte(testRelease), false},
+		{"surrounding-space", openpgp.EntityList{key}, append(append([]byte("\n \n"), signed...), "\n\n"...), true},
+		{"prepended", openpgp.EntityList{key}, append([]byte("Suite: evil\n"), signed...), false},
+		{"appended", openpgp.EntityList{key}, append(append([]byte{}, signed...), "Suite: evil\n"...), false},
+		{"appended-message", openpgp.EntityList{key}, append(append([]byte{}, signed...), clearsignData(t, other, "Suite: evil\n")...), false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			signer, err := checkClearsigned(test.keyring, test.data)
+			if !test.ok {
+				if err == nil {
+					t.Fatal("expected error not found")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if signer.PrimaryKey.KeyId != key.PrimaryKey.KeyId {
+				t.Fatalf("wrong signer %016X returned", signer.PrimaryKey.KeyId)
+			}
+		})
+	}
+}
+
+func TestCheckDetached(t *testing.T) {
+	key := newTestKey(t, "archive")
+	other := newTestKey(t, "other")
+
+	sig := detachSign(t, key, testRelease, false)
+	armored := detachSign(t, key, testRelease, true)
+
+	var tests = []struct {
+		name    string
+		keyring openpgp.EntityList
+		data    string
+		sig     []byte
+		ok      bool
+	}{
+		{"valid", openpgp.EntityList{key}, testRelease, sig, true},
+		{"valid-armored", openpgp.EntityList{key}, testRelease, armored, true},
+		{"wrong-key", openpgp.EntityList{other}, testRelease, sig, false},
+		{"wrong-key-armored", openpgp.EntityList{other}, testRelease, armored, false},
+		{"modified", openpgp.EntityList{key}, testRelease + "Version: 10\n", sig, false},
+		{"no-signature", openpgp.EntityList{key}, testRelease, []byte("garbage"), false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			signer, err := checkDetached(test.keyring, []byte(test.data), test.sig)
+			if !test.ok {
+				if err == nil {
+					t.Fatal("expected error not found")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if signer.PrimaryKey.KeyId != key.PrimaryKey.KeyId {
+				t.Fatalf("wrong signer %016X returned", signer.PrimaryKey.KeyId)
+			}
+		})
+	}
+}
+
+func TestProxyVerifySignature(t *testing.T) {
+	key := newTestKey(t, "archive")
+	other := newTestKey(t, "other")
+
+	files := map[string][]byte{
+		"/dists/buster/InRelease":   clearsignData(t, key, testRelease),
+		"/dists/buster/Release":     []byte(testRelease),
+		"/dists/buster/Release.gpg": detachSign(t, key, testRelease, true),
+	}
+	files["/dists/evil/InRelease"] = append(append([]byte{}, files["/dists/buster/InRelease"]...), "Suite: evil\n"...)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		buf, ok := files[req.URL.Path]
+		if !ok {
+			http.NotFound(rw, req)
+			return
+		}
+		_, _ = rw.Write(buf)
+	}))
+	defer upstream.Close()
+
+	var tests = []struct {
+		name   string
+		key    *openpgp.Entity
+		path   string
+		status int
+	}{
+		{"inrelease", key, "/debian/dists/buster/InRelease", http.StatusOK},
+		{"release", key, "/debian/dists/buster/Release", http.StatusOK},
+		{"release-gpg", key, "/debian/dists/buster/Release.gpg", http.StatusOK},
+		{"inrelease-wrong-key", other, "/debian/dists/buster/InRelease", http.StatusBadGateway},
+		{"release-wrong-key", other, "/debian/dists/buster/Release", http.StatusBadGateway},
+		{"release-gpg-wrong-key", other, "/debian/dists/buster/Release.gpg", http.StatusBadGateway},
+		{"inrelease-appended", key, "/debian/dists/evil/InRelease", http.StatusBadGateway},
+		{"missing", key, "/debian/dists/bullseye/InRelease", http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			keyring := writeKeyring(t, test.key)
+			defer func() {
+				_ = os.Remove(keyring)
+			}()
+
+			srv := newTestProxy(t, Path{Path: "/debian", URL: upstream.URL, GPGKeyring: &keyring})
+			defer srv.Close()
+
+			res, body := get(t, srv.URL+test.path)
+			if res.StatusCode != test.status {
+				t.Fatalf("wrong status, want %v, got %v", test.status, res.StatusCode)
+			}
+
+			if test.status != http.StatusOK {
+				return
+			}
+
+			want := string(files[test.path[len("/debian"):]])
+			if body != want {
+				t.Fatalf("wrong body, want %q, got %q", want, body)
+			}
+		})
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import "net/http"
+
+// defaults for the header limits
+const (
+	defaultMaxHeaderBytes     = 64 << 10
+	defaultMaxRequestHeaders  = 100
+	defaultMaxResponseHeaders = 100
+)
+
+// countHeaders returns the number of header fields in header, a field with
+// several values counts once per value.
+func countHeaders(header http.Header) int {
+	n := 0
+	for _, values := range header {
+		n += len(values)
+	}
+	return n
+}
+
+// LimitHeaders answers requests with more than max header fields with 431,
+// all other requests are passed to next. The total size of the header is
+// limited by http.Server.MaxHeaderBytes.
+func LimitHeaders(next http.Handler, max int, shared *Shared) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if n := countHeaders(req.Header); n > max {
+			shared.writeError(rw, req, "", errHeaderTooLarge("%v %v %v reject request with %d header fields", clientIP(req), req.Method, req.URL.Path, n))
+			return
+		}
+
+		next.ServeHTTP(rw, req)
+	})
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// defaultFilterRequestHeaders lists the request header fields which are not
+// sent to the upstream server: the hop-by-hop fields from RFC 7230, section
+// 6.1, the non-standard Proxy-Connection, HTTP2-Settings used for upgrading
+// to h2c, and Expect, since requests are sent to the upstream server without
+// a body.
+var defaultFilterRequestHeaders = []string{
+	"Connection",
+	"Expect",
+	"HTTP2-Settings",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"TE",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// defaultFilterResponseHeaders lists the header fields of upstream responses
+// which are not passed on to the client.
+var defaultFilterResponseHeaders = []string{
+	"Set-Cookie",
+	"Set-Cookie2",
+}
+
+// framingHeaders describe how the body of a response is transferred, they
+// are always passed on to the client, even when not in the allowlist.
+var framingHeaders = headerSet([]string{
+	"Content-Encoding",
+	"Content-Length",
+	"Content-Range",
+	"Transfer-Encoding",
+})
+
+// headerSet returns a set of the canonical forms of names.
+func headerSet(names []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		set[http.CanonicalHeaderKey(name)] = struct{}{}
+	}
+	return set
+}
+
+// copyRequestHeader copies the fields in src to dst, except for those in
+// filter and those listed in the Connection header of src, which only
+// concern the connection from the client.
+func copyRequestHeader(dst, src http.Header, filter map[string]struct{}) {
+	connection := make(map[string]struct{})
+	for _, value := range src["Connection"] {
+		for _, name := range strings.Split(value, ",") {
+			connection[http.CanonicalHeaderKey(strings.TrimSpace(name))] = struct{}{}
+		}
+	}
+
+	for name, values := range src {
+		if _, ok := filter[name]; ok {
+			continue
+		}
+		if _, ok := connection[name]; ok {
+			continue
+		}
+		dst[name] = values
+	}
+}
+
+// copyResponseHeader copies the fields in src to dst, except for those in
+// deny. If allow is not nil, only the fields in allow and the framing fields
+// are copied.
+func copyResponseHeader(dst, src http.Header, allow, deny map[string]struct{}) {
+	for name, values := range src {
+		if _, ok := deny[name]; ok {
+			continue
+		}
+
+		if allow != nil {
+			_, allowed := allow[name]
+			_, framing := framingHeaders[name]
+			if !allowed && !framing {
+				continue
+			}
+		}
+
+		dst[name] = values
+	}
+}
+
+// applyResponseHeaders removes and sets the header fields configured in rules
+// on header. A nil rules does nothing.
+func applyResponseHeaders(header http.Header, rules *ResponseHeaders) {
+	if rules == nil {
+		return
+	}
+
+	for _, name := range rules.Remove {
+		header.Del(name)
+	}
+
+	for name, value := range rules.Set {
+		header.Set(name, value)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// errQueueTimeout is returned by UpstreamLimiter.Acquire when no slot became
+// available in time.
+var errQueueTimeout = errors.New("timeout waiting for a free upstream connection")
+
+// UpstreamLimiter bounds the number of concurrent requests to the upstream
+// servers, both in total and per upstream host. Requests above the limit are
+// queued until a slot is available or the timeout passes. A nil
+// *UpstreamLimiter does not limit anything.
+type UpstreamLimiter struct {
+	total   chan struct{}
+	perHost int
+	timeout time.Duration
+
+	m     sync.Mutex
+	hosts map[string]chan struct{}
+}
+
+// NewUpstreamLimiter returns a limiter allowing total concurrent upstream
+// requests and perHost concurrent requests to a single host. Zero disables
+// the respective limit.
+func NewUpstreamLimiter(total, perHost int, timeout time.Duration) *UpstreamLimiter {
+	l := &UpstreamLimiter{
+		perHost: perHost,
+		timeout: timeout,
+		hosts:   make(map[string]chan struct{}),
+	}
+
+	if total > 0 {
+		l.total = make(chan struct{}, total)
+	}
+
+	return l
+}
+
+func (l *UpstreamLimiter) hostSemaphore(host string) chan struct{} {
+	if l.perHost <= 0 {
+		return nil
+	}
+
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	sem, ok := l.hosts[host]
+	if !ok {
+		sem = make(chan struct{}, l.perHost)
+		l.hosts[host] = sem
+	}
+
+	return sem
+}
+
+// Acquire waits for a free slot for a request to host. On success, the
+// returned function must be called to release the slot when the upstream
+// response has been processed.
+func (l *UpstreamLimiter) Acquire(ctx context.Context, host string) (release func(), err error) {
+	if l == nil {
+		return func() {}, nil
+	}
+
+	var acquired []chan struct{}
+	release = func() {
+		for _, sem := range acquired {
+			<-sem
+		}
+	}
+
+	// the timeout only starts when a request has to wait, so that a free
+	// slot is always taken, even with a zero timeout
+	var deadline time.Time
+	for _, sem := range []chan struct{}{l.hostSemaphore(host), l.total} {
+		if sem == nil {
+			continue
+		}
+
+		select {
+		case sem <- struct{}{}:
+			acquired = append(acquired, sem)
+			continue
+		default:
+		}
+
+		if deadline.IsZero() {
+			deadline = time.Now().Add(l.timeout)
+		}
+
+		err := wait(ctx, sem, deadline)
+		if err != nil {
+			release()
+			return nil, err
+		}
+		acquired = append(acquired, sem)
+	}
+
+	return release, nil
+}
+
+// wait blocks until a slot in sem is free or the deadline has passed.
+func wait(ctx context.Context, sem chan struct{}, deadline time.Time) error {
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+
+	select {
+	case sem <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			return errQueueTimeout
+		}
+		return ctx.Err()
+	}
+}
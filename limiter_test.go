@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestUpstreamLimiter(t *testing.T) {
+	var tests = []struct {
+		name    string
+		total   int
+		perHost int
+		timeout time.Duration
+		held    []string
+		host    string
+		err     error
+	}{
+		{"unlimited", 0, 0, 0, []string{"a", "a", "a"}, "a", nil},
+		{"free-zero-timeout", 2, 2, 0, nil, "a", nil},
+		{"free-total", 2, 0, 0, []string{"a"}, "a", nil},
+		{"full-total", 2, 0, 10 * time.Millisecond, []string{"a", "b"}, "c", errQueueTimeout},
+		{"full-total-zero-timeout", 1, 0, 0, []string{"a"}, "a", errQueueTimeout},
+		{"free-host", 0, 1, 0, []string{"a"}, "b", nil},
+		{"full-host", 0, 1, 10 * time.Millisecond, []string{"a"}, "a", errQueueTimeout},
+		{"full-host-free-total", 10, 1, 10 * time.Millisecond, []string{"a"}, "a", errQueueTimeout},
+		{"free-host-full-total", 2, 1, 10 * time.Millisecond, []string{"a", "b"}, "c", errQueueTimeout},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			l := NewUpstreamLimiter(test.total, test.perHost, test.timeout)
+
+			for _, host := range test.held {
+				release, err := l.Acquire(context.Background(), host)
+				if err != nil {
+					t.Fatalf("acquire for %v failed: %v", host, err)
+				}
+				defer release()
+			}
+
+			release, err := l.Acquire(context.Background(), test.host)
+			if err != test.err {
+				t.Fatalf("wrong error, want %v, got %v", test.err, err)
+			}
+
+			if err == nil {
+				release()
+			}
+		})
+	}
+}
+
+func TestUpstreamLimiterRelease(t *testing.T) {
+	l := NewUpstreamLimiter(1, 1, 0)
+
+	// a zero timeout must never reject requests while the slots are free
+	for i := 0; i < 100; i++ {
+		release, err := l.Acquire(context.Background(), "a")
+		if err != nil {
+			t.Fatalf("acquire %d failed: %v", i, err)
+		}
+		release()
+	}
+}
+
+func TestUpstreamLimiterWait(t *testing.T) {
+	l := NewUpstreamLimiter(1, 0, time.Minute)
+
+	release, err := l.Acquire(context.Background(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		release()
+	}()
+
+	// the queued request gets the slot once it is released
+	release, err = l.Acquire(context.Background(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+}
+
+func TestUpstreamLimiterCancel(t *testing.T) {
+	l := NewUpstreamLimiter(1, 0, time.Minute)
+
+	release, err := l.Acquire(context.Background(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = l.Acquire(ctx, "a")
+	if err != context.Canceled {
+		t.Fatalf("wrong error, want %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestUpstreamLimiterNil(t *testing.T) {
+	var l *UpstreamLimiter
+
+	release, err := l.Acquire(context.Background(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+}
+
+func TestProxyMaxParallel(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	maxParallel := 1
+	srv := newTestProxy(t, Path{Path: "/debian", URL: upstream.URL, MaxParallel: &maxParallel})
+	defer srv.Close()
+
+	// the queue timeout is zero, sequential requests must still succeed
+	for i := 0; i < 20; i++ {
+		res, _ := get(t, srv.URL+"/debian/x.deb")
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("request %d: wrong status, want %v, got %v", i, http.StatusOK, res.StatusCode)
+		}
+	}
+}
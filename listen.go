@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// defaultListenAddress is used when no address is configured.
+const defaultListenAddress = ":8080"
+
+// endpoint is an address distriproxy accepts connections on.
+type endpoint struct {
+	Address       string
+	TLS           bool
+	RedirectHTTPS bool
+}
+
+// getEndpoints returns the addresses to listen on. These are either the
+// listener blocks from the config file or, if there are none, the single
+// address configured with listen and tls_enable.
+func getEndpoints(cfg Config) ([]endpoint, error) {
+	if len(cfg.Listeners) == 0 {
+		address := defaultListenAddress
+		if cfg.Listen != nil {
+			address = *cfg.Listen
+		}
+
+		return []endpoint{{Address: address, TLS: *cfg.TLSEnable}}, nil
+	}
+
+	var endpoints []endpoint
+	for _, l := range cfg.Listeners {
+		ep := endpoint{Address: l.Address}
+		if l.TLS != nil {
+			ep.TLS = *l.TLS
+		}
+
+		if l.RedirectHTTPS != nil {
+			ep.RedirectHTTPS = *l.RedirectHTTPS
+		}
+
+		if ep.TLS && (cfg.TLSCertificateFile == nil || cfg.TLSKeyFile == nil) {
+			return nil, fmt.Errorf("listener %v: TLS enabled but tls_certificate_file or tls_key_file not set", l.Address)
+		}
+
+		if ep.TLS && ep.RedirectHTTPS {
+			return nil, fmt.Errorf("listener %v: redirect_https needs a listener without TLS", l.Address)
+		}
+
+		endpoints = append(endpoints, ep)
+	}
+
+	return endpoints, nil
+}
+
+// getListeners returns a listener for each address. If socketActivation is
+// true, the sockets passed in by systemd are requested via activated (e.g.
+// activation.Listeners) and used in order if there is one for each address.
+// Otherwise, or if the activation fails, new sockets are opened, see
+// listenOn. The returned bool reports whether the listeners were supplied by
+// systemd.
+func getListeners(addresses []string, socketMode os.FileMode, socketActivation bool, activated func() ([]net.Listener, error)) ([]net.Listener, bool, error) {
+	if socketActivation {
+		listeners, err := activated()
+		if err != nil {
+			log.Printf("systemd socket activation failed: %v, falling back to %v", err, addresses)
+		}
+
+		switch len(listeners) {
+		case 0:
+			// no listeners found, listen manually below
+		case len(addresses):
+			// one listener per address supplied by systemd, use them
+			return listeners, true, nil
+		default:
+			return nil, false, fmt.Errorf("got %d listeners, expected %d", len(listeners), len(addresses))
+		}
+	}
+
+	var listeners []net.Listener
+	for _, address := range addresses {
+		listener, err := listenOn(address, socketMode)
+		if err != nil {
+			for _, l := range listeners {
+				_ = l.Close()
+			}
+			return nil, false, fmt.Errorf("unable to bind to %v: %v", address, err)
+		}
+		listeners = append(listeners, listener)
+	}
+
+	return listeners, false, nil
+}
+
+// redirectHTTPS returns a handler which redirects all requests to the same
+// URL via https, using the given port.
+func redirectHTTPS(port string) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		host := req.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+
+		if port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+
+		setServer(rw.Header())
+		http.Redirect(rw, req, "https://"+host+req.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// httpsPort returns the port of the first TLS endpoint.
+func httpsPort(endpoints []endpoint) (string, error) {
+	for _, ep := range endpoints {
+		if !ep.TLS {
+			continue
+		}
+
+		network, addr := parseListenAddress(ep.Address)
+		if network != "tcp" {
+			continue
+		}
+
+		_, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return "", err
+		}
+		return port, nil
+	}
+
+	return "", errors.New("redirect_https needs a TCP listener with TLS enabled")
+}
+
+// parseListenAddress splits address into the network and the address for
+// net.Listen. Addresses of the form `unix:/path/to/socket` are Unix domain
+// sockets, all others (optionally prefixed with `tcp:`) are TCP addresses.
+func parseListenAddress(address string) (network, addr string) {
+	if strings.HasPrefix(address, "unix:") {
+		return "unix", strings.TrimPrefix(address, "unix:")
+	}
+
+	return "tcp", strings.TrimPrefix(address, "tcp:")
+}
+
+// listenOn opens a listener on address. For Unix domain sockets, a stale
+// socket file left over from a previous run is removed first, and the
+// permissions of the new socket are set to socketMode (if non-zero).
+func listenOn(address string, socketMode os.FileMode) (net.Listener, error) {
+	network, addr := parseListenAddress(address)
+	if network != "unix" {
+		return net.Listen(network, addr)
+	}
+
+	err := removeStaleSocket(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	listener, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if socketMode != 0 {
+		err = os.Chmod(addr, socketMode)
+		if err != nil {
+			_ = listener.Close()
+			return nil, err
+		}
+	}
+
+	return listener, nil
+}
+
+// removeStaleSocket removes the socket file at filename if no process
+// accepts connections on it any more.
+func removeStaleSocket(filename string) error {
+	fi, err := os.Lstat(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%v exists and is not a socket", filename)
+	}
+
+	conn, err := net.Dial("unix", filename)
+	if err == nil {
+		_ = conn.Close()
+		return fmt.Errorf("socket %v is still in use", filename)
+	}
+
+	return os.Remove(filename)
+}
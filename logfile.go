@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// defaults for writing the access log to a file
+const (
+	defaultAccessLogBufferSize    = 64 << 10
+	defaultAccessLogFlushInterval = time.Second
+)
+
+// rotatedSuffix is the time format appended to the name of rotated log files.
+const rotatedSuffix = "20060102-150405.000000"
+
+// LogFile is a buffered writer for a log file. The buffer is flushed
+// periodically, when it is full and when the file is closed.
+type LogFile struct {
+	m        sync.Mutex
+	filename string
+	size     int
+	compress bool
+	f        *os.File
+	wr       *bufio.Writer
+}
+
+// OpenLogFile opens filename for appending with a buffer of size bytes. If
+// compress is set, the file is rotated and compressed with gzip on SIGHUP
+// instead of being reopened.
+func OpenLogFile(filename string, size int, compress bool) (*LogFile, error) {
+	l := &LogFile{filename: filename, size: size, compress: compress}
+	err := l.open()
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *LogFile) open() error {
+	f, err := os.OpenFile(l.filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	l.f = f
+	l.wr = bufio.NewWriterSize(f, l.size)
+	return nil
+}
+
+func (l *LogFile) Write(p []byte) (int, error) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	return l.wr.Write(p)
+}
+
+// Flush writes the buffered data to the file.
+func (l *LogFile) Flush() error {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	return l.wr.Flush()
+}
+
+// Reopen flushes and closes the file and opens it again, so that a log file
+// which has been moved away (e.g. by logrotate) is created again.
+func (l *LogFile) Reopen() error {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	err := l.wr.Flush()
+	if err != nil {
+		return err
+	}
+
+	err = l.f.Close()
+	if err != nil {
+		return err
+	}
+
+	return l.open()
+}
+
+// Rotate flushes and closes the file, renames it by appending the current
+// time and opens a new file. The old file is then compressed with gzip, the
+// name of the compressed file is returned.
+func (l *LogFile) Rotate() (string, error) {
+	l.m.Lock()
+	rotated := l.filename + "." + time.Now().Format(rotatedSuffix)
+	err := l.rotate(rotated)
+	l.m.Unlock()
+	if err != nil {
+		return "", err
+	}
+
+	return compressFile(rotated)
+}
+
+func (l *LogFile) rotate(rotated string) error {
+	err := l.wr.Flush()
+	if err != nil {
+		return err
+	}
+
+	err = l.f.Close()
+	if err != nil {
+		return err
+	}
+
+	renameErr := os.Rename(l.filename, rotated)
+
+	// if renaming failed, writing continues in the old file
+	err = l.open()
+	if err != nil {
+		return err
+	}
+
+	return renameErr
+}
+
+// compressFile compresses filename with gzip into filename.gz and removes
+// filename. The name of the compressed file is returned.
+func compressFile(filename string) (string, error) {
+	target := filename + ".gz"
+
+	in, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = in.Close()
+	}()
+
+	out, err := os.OpenFile(target+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return "", err
+	}
+
+	wr := gzip.NewWriter(out)
+	_, err = io.Copy(wr, in)
+	if err == nil {
+		err = wr.Close()
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if err != nil {
+		_ = out.Close()
+		_ = os.Remove(target + ".tmp")
+		return "", err
+	}
+
+	err = out.Close()
+	if err != nil {
+		_ = os.Remove(target + ".tmp")
+		return "", err
+	}
+
+	err = os.Rename(target+".tmp", target)
+	if err != nil {
+		return "", err
+	}
+
+	return target, os.Remove(filename)
+}
+
+// Close flushes the buffered data and closes the file.
+func (l *LogFile) Close() error {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	err := l.wr.Flush()
+	if err != nil {
+		_ = l.f.Close()
+		return err
+	}
+
+	return l.f.Close()
+}
+
+// flushEvery flushes l periodically in the background.
+func (l *LogFile) flushEvery(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			err := l.Flush()
+			if err != nil {
+				log.Printf("flushing %v failed: %v", l.filename, err)
+			}
+		}
+	}()
+}
+
+// reopenOnSignal reopens l each time SIGHUP is received, or rotates it if
+// compression is enabled.
+func (l *LogFile) reopenOnSignal() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+
+	go func() {
+		for range ch {
+			if l.compress {
+				name, err := l.Rotate()
+				if err != nil {
+					log.Printf("rotating %v failed: %v", l.filename, err)
+					continue
+				}
+				log.Printf("received SIGHUP, rotated %v to %v", l.filename, name)
+				continue
+			}
+
+			err := l.Reopen()
+			if err != nil {
+				log.Printf("reopening %v failed: %v", l.filename, err)
+				continue
+			}
+			log.Printf("received SIGHUP, reopened %v", l.filename)
+		}
+	}()
+}
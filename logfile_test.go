@@ -0,0 +1,252 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeLines writes the lines from first to last (exclusive) to l.
+func writeLines(t *testing.T, l *LogFile, first, last int) string {
+	t.Helper()
+
+	var want string
+	for i := first; i < last; i++ {
+		line := fmt.Sprintf("line %d\n", i)
+		_, err := l.Write([]byte(line))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want += line
+	}
+
+	return want
+}
+
+// readFile returns the content of filename, it fails the test on error.
+func readFile(t *testing.T, filename string) string {
+	t.Helper()
+
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(buf)
+}
+
+func tempDir(t *testing.T) (string, func()) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "distriproxy-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return dir, func() {
+		_ = os.RemoveAll(dir)
+	}
+}
+
+func TestLogFileClose(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	filename := filepath.Join(dir, "access.log")
+	l, err := OpenLogFile(filename, 1<<20, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := writeLines(t, l, 0, 1000)
+
+	// the lines are still in the buffer
+	if data := readFile(t, filename); data != "" {
+		t.Fatalf("data was written before flushing: %q", data)
+	}
+
+	err = l.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if data := readFile(t, filename); data != want {
+		t.Fatalf("wrong data after close, want %d bytes, got %d", len(want), len(data))
+	}
+}
+
+func TestLogFileAppend(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	filename := filepath.Join(dir, "access.log")
+	err := ioutil.WriteFile(filename, []byte("existing\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := OpenLogFile(filename, 1<<20, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "existing\n" + writeLines(t, l, 0, 10)
+
+	err = l.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if data := readFile(t, filename); data != want {
+		t.Fatalf("wrong data, want %q, got %q", want, data)
+	}
+}
+
+func TestLogFileFlushEvery(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	filename := filepath.Join(dir, "access.log")
+	l, err := OpenLogFile(filename, 1<<20, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = l.Close()
+	}()
+
+	l.flushEvery(10 * time.Millisecond)
+	want := writeLines(t, l, 0, 10)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for readFile(t, filename) != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("data was not flushed, got %q", readFile(t, filename))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLogFileReopen(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	filename := filepath.Join(dir, "access.log")
+	l, err := OpenLogFile(filename, 1<<20, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want1 := writeLines(t, l, 0, 10)
+
+	// rotate the file like logrotate does, lines written until the file is
+	// reopened still end up in the old file
+	err = os.Rename(filename, filename+".1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want1 += writeLines(t, l, 10, 20)
+
+	err = l.Reopen()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want2 := writeLines(t, l, 20, 30)
+
+	err = l.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if data := readFile(t, filename+".1"); data != want1 {
+		t.Errorf("wrong data in rotated file, want %q, got %q", want1, data)
+	}
+
+	if data := readFile(t, filename); data != want2 {
+		t.Errorf("wrong data in new file, want %q, got %q", want2, data)
+	}
+}
+
+// readGzipFile returns the decompressed content of filename.
+func readGzipFile(t *testing.T, filename string) string {
+	t.Helper()
+
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	rd, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf, err := ioutil.ReadAll(rd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(buf)
+}
+
+func TestLogFileRotate(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	filename := filepath.Join(dir, "access.log")
+	l, err := OpenLogFile(filename, 1<<20, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var segments []string
+	for i := 0; i < 3; i++ {
+		want := writeLines(t, l, i*10, i*10+10)
+
+		name, err := l.Rotate()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !strings.HasPrefix(name, filename+".") || !strings.HasSuffix(name, ".gz") {
+			t.Fatalf("unexpected name for rotated file: %v", name)
+		}
+
+		if data := readGzipFile(t, name); data != want {
+			t.Fatalf("wrong data in %v, want %q, got %q", name, want, data)
+		}
+
+		segments = append(segments, name)
+	}
+
+	want := writeLines(t, l, 30, 40)
+
+	err = l.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if data := readFile(t, filename); data != want {
+		t.Errorf("wrong data in current file, want %q, got %q", want, data)
+	}
+
+	// only the compressed segments and the current file remain
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(files) != len(segments)+1 {
+		t.Errorf("unexpected files in %v: %v", dir, files)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// LogLevel controls which messages are logged. The zero value is LogInfo.
+type LogLevel int
+
+// the log levels, each level includes the messages of the levels above
+const (
+	LogError LogLevel = iota - 2
+	LogWarn
+	LogInfo
+	LogDebug
+)
+
+var logLevelNames = map[string]LogLevel{
+	"error": LogError,
+	"warn":  LogWarn,
+	"info":  LogInfo,
+	"debug": LogDebug,
+}
+
+// ParseLogLevel returns the log level for name.
+func ParseLogLevel(name string) (LogLevel, error) {
+	level, ok := logLevelNames[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("unknown log_level %q", name)
+	}
+	return level, nil
+}
+
+// logf logs the message if level is enabled in s.LogLevel.
+func (s *Shared) logf(level LogLevel, msg string, args ...interface{}) {
+	if level > s.LogLevel {
+		return
+	}
+	log.Printf(msg, args...)
+}
+
+// redactedHeaders contains the header fields whose values are not logged,
+// only the authentication scheme is kept.
+var redactedHeaders = map[string]struct{}{
+	"Authorization":       {},
+	"Proxy-Authorization": {},
+}
+
+// redact returns the value of a header field with credentials, without the
+// credentials.
+func redact(value string) string {
+	if i := strings.IndexByte(value, ' '); i > 0 {
+		return value[:i] + " [redacted]"
+	}
+	return "[redacted]"
+}
+
+// formatHeader returns the header in wire format with sorted names, for
+// debug logging. Credentials are redacted.
+func formatHeader(header http.Header) string {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	for _, name := range names {
+		_, secret := redactedHeaders[name]
+		for _, value := range header[name] {
+			if secret {
+				value = redact(value)
+			}
+			fmt.Fprintf(&sb, "\n    %v: %v", name, value)
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestFormatHeader(t *testing.T) {
+	var tests = []struct {
+		name   string
+		header http.Header
+		want   string
+	}{
+		{
+			"sorted",
+			http.Header{"User-Agent": {"apt"}, "Accept": {"*/*"}},
+			"\n    Accept: */*\n    User-Agent: apt",
+		},
+		{
+			"multiple-values",
+			http.Header{"Via": {"1.1 a", "1.1 b"}},
+			"\n    Via: 1.1 a\n    Via: 1.1 b",
+		},
+		{
+			"authorization",
+			http.Header{"Authorization": {"Basic YWxpY2U6c2VjcmV0"}},
+			"\n    Authorization: Basic [redacted]",
+		},
+		{
+			"proxy-authorization",
+			http.Header{"Proxy-Authorization": {"Bearer secret-token"}},
+			"\n    Proxy-Authorization: Bearer [redacted]",
+		},
+		{
+			"no-scheme",
+			http.Header{"Authorization": {"secret-token"}},
+			"\n    Authorization: [redacted]",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := formatHeader(test.header)
+			if got != test.want {
+				t.Fatalf("wrong result, want %q, got %q", test.want, got)
+			}
+
+			if strings.Contains(got, "secret") || strings.Contains(got, "YWxpY2U6c2VjcmV0") {
+				t.Fatalf("credentials not redacted: %q", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// hopsHeader lists the node IDs of the distriproxy instances a request has
+// passed through.
+const hopsHeader = "X-Distriproxy-Hops"
+
+// seenNode reports whether the hops header contains nodeID.
+func seenNode(header http.Header, nodeID string) bool {
+	for _, value := range header[hopsHeader] {
+		for _, id := range strings.Split(value, ",") {
+			if strings.TrimSpace(id) == nodeID {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// DetectLoops answers requests which have already passed through the node
+// nodeID with 508, all other requests are passed to next. The node ID is
+// added to the hops header of upstream requests by the proxy.
+func DetectLoops(next http.Handler, nodeID string, shared *Shared) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if seenNode(req.Header, nodeID) {
+			shared.writeError(rw, req, "", errLoopDetected("%v %v %v reject request, loop detected: %v", clientIP(req), req.Method, req.URL.Path, strings.Join(req.Header[hopsHeader], ", ")))
+			return
+		}
+
+		next.ServeHTTP(rw, req)
+	})
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSeenNode(t *testing.T) {
+	var tests = []struct {
+		hops []string
+		seen bool
+	}{
+		{nil, false},
+		{[]string{""}, false},
+		{[]string{"edge-1"}, true},
+		{[]string{"edge-2"}, false},
+		{[]string{"edge-10"}, false},
+		{[]string{"central, edge-1"}, true},
+		{[]string{"central,edge-1 , regional"}, true},
+		{[]string{"central", "edge-1"}, true},
+		{[]string{"central", "regional"}, false},
+	}
+
+	for _, test := range tests {
+		header := http.Header{hopsHeader: test.hops}
+		if seenNode(header, "edge-1") != test.seen {
+			t.Errorf("wrong result for %q, want %v", test.hops, test.seen)
+		}
+	}
+}
+
+func TestDetectLoops(t *testing.T) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte("next\n"))
+	})
+	handler := DetectLoops(next, "edge-1", &Shared{LogLevel: LogError})
+
+	var tests = []struct {
+		name   string
+		hops   []string
+		status int
+		body   string
+	}{
+		{"none", nil, http.StatusOK, "next\n"},
+		{"other", []string{"regional-1, central"}, http.StatusOK, "next\n"},
+		{"own", []string{"edge-1"}, http.StatusLoopDetected, "loop detected\n"},
+		{"own-chain", []string{"edge-1, regional-1"}, http.StatusLoopDetected, "loop detected\n"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/debian/dists/buster/Release", nil)
+			if test.hops != nil {
+				req.Header[hopsHeader] = test.hops
+			}
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != test.status {
+				t.Errorf("wrong status, want %v, got %v", test.status, rec.Code)
+			}
+
+			if rec.Body.String() != test.body {
+				t.Errorf("wrong body, want %q, got %q", test.body, rec.Body.String())
+			}
+		})
+	}
+}
+
+// newChainedProxy configures the unstarted server srv as node id, which
+// proxies requests below /debian to upstream.
+func newChainedProxy(t *testing.T, srv *httptest.Server, id, upstream string) {
+	t.Helper()
+
+	shared := &Shared{LogLevel: LogError, NodeID: id}
+	proxy, err := NewProxy(Path{Path: "/debian", URL: upstream}, nil, shared)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/debian/", proxy)
+	srv.Config.Handler = DetectLoops(mux, id, shared)
+}
+
+func TestProxyLoop(t *testing.T) {
+	// the edge proxy uses the central one as upstream, which was
+	// misconfigured to use the edge proxy
+	edge := httptest.NewUnstartedServer(nil)
+	central := httptest.NewUnstartedServer(nil)
+
+	newChainedProxy(t, edge, "edge-1", "http://"+central.Listener.Addr().String()+"/debian")
+	newChainedProxy(t, central, "central", "http://"+edge.Listener.Addr().String()+"/debian")
+
+	edge.Start()
+	defer edge.Close()
+	central.Start()
+	defer central.Close()
+
+	res, body := get(t, edge.URL+"/debian/dists/buster/Release")
+	if res.StatusCode != http.StatusLoopDetected {
+		t.Fatalf("wrong status, want %v, got %v", http.StatusLoopDetected, res.Status)
+	}
+
+	if body != "loop detected\n" {
+		t.Fatalf("wrong body %q", body)
+	}
+}
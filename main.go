@@ -2,38 +2,36 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/coreos/go-systemd/activation"
 	"github.com/hashicorp/hcl2/hcl"
 	"github.com/spf13/pflag"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
-// config configures the upstream servers which are reachable at a given path.
-// The key of the map is the path, the value the upstream URL.
-//
-// For example, using the path `/foo` and the URL `https://example.com/bar`,
-// requesting `/foo/x.tar.gz` would request the URL
-// `https://example.com/bar/x.tar.gz` in the background.
-var config = map[string]string{
-	"/debian":           "https://deb.debian.org/debian",
-	"/debian-security":  "https://deb.debian.org/debian-security",
-	"/centos":           "https://ftp.halifax.rwth-aachen.de/centos",
-	"/centos-vault":     "http://vault.centos.org",
-	"/centos-debuginfo": "http://debuginfo.centos.org",
-	"/centos-epel":      "https://mirror.netcologne.de/fedora-epel",
-}
-
 // wait ten seconds for clients to finish their business before shutting down
 const shutdownTimeout = 10 * time.Second
 
-func gracefulShutdown(srv *http.Server) <-chan struct{} {
+// gracefulShutdown shuts the servers down when SIGINT or SIGTERM is received
+// or restart is closed. The returned channel is closed when all servers are
+// done.
+func gracefulShutdown(servers []*http.Server, restart <-chan struct{}) <-chan struct{} {
 	done := make(chan struct{})
 
 	// install signal handler for INT and TERM
@@ -41,17 +39,31 @@ func gracefulShutdown(srv *http.Server) <-chan struct{} {
 	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
 
 	go func() {
-		// wait for signal
-		c := <-ch
-		log.Printf("received %v, shutting down gracefully", c)
+		// wait for signal or restart
+		select {
+		case c := <-ch:
+			log.Printf("received %v, shutting down gracefully", c)
+		case <-restart:
+			log.Printf("new process started, shutting down gracefully")
+		}
 
 		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
 		defer cancel()
 
-		err := srv.Shutdown(ctx)
-		if err != nil {
-			log.Fatalf("shutdown failed: %v", err)
+		var wg sync.WaitGroup
+		for _, srv := range servers {
+			wg.Add(1)
+			go func(srv *http.Server) {
+				defer wg.Done()
+
+				err := srv.Shutdown(ctx)
+				if err != nil {
+					log.Fatalf("shutdown failed: %v", err)
+				}
+			}(srv)
 		}
+
+		wg.Wait()
 		close(done)
 	}()
 
@@ -64,6 +76,14 @@ type Options struct {
 	CertificateFile string
 	KeyFile         string
 	ConfigFile      string
+
+	Listen             string
+	NoSocketActivation bool
+
+	Version bool
+
+	SignPath  string
+	SignValid time.Duration
 }
 
 func parseConfigOptions() Config {
@@ -74,6 +94,11 @@ func parseConfigOptions() Config {
 	flags.StringVar(&opts.CertificateFile, "certificate", "", "Load TLS certificate from `filename`")
 	flags.StringVar(&opts.KeyFile, "key", "", "Load TLS key from `filename`")
 	flags.StringVar(&opts.ConfigFile, "config", "distriproxy.conf", "Load config from `filename`")
+	flags.StringVar(&opts.Listen, "listen", defaultListenAddress, "Listen on `addr` (host:port or unix:/path) if no socket is passed in by systemd")
+	flags.BoolVar(&opts.NoSocketActivation, "no-socket-activation", false, "Ignore sockets passed in by systemd")
+	flags.BoolVar(&opts.Version, "version", false, "Print version information and exit")
+	flags.StringVar(&opts.SignPath, "sign", "", "Print a signed URL query string for `path` (requires auth scheme signed) and exit")
+	flags.DurationVar(&opts.SignValid, "sign-valid", 24*time.Hour, "Signed URLs are valid for `duration`")
 
 	err := flags.Parse(os.Args)
 	if err == pflag.ErrHelp {
@@ -90,6 +115,11 @@ func parseConfigOptions() Config {
 		os.Exit(2)
 	}
 
+	if opts.Version {
+		fmt.Printf("distriproxy %v\ncommit %v\nbuilt %v\n", version, commit, buildDate)
+		os.Exit(0)
+	}
+
 	cfg, err := ParseConfig(opts.ConfigFile)
 	if err != nil {
 		if e, ok := err.(hcl.Diagnostics); ok {
@@ -102,6 +132,23 @@ func parseConfigOptions() Config {
 		os.Exit(3)
 	}
 
+	if opts.SignPath != "" {
+		if cfg.Auth == nil || cfg.Auth.Scheme != "signed" {
+			log.Printf("error: --sign requires an auth block with scheme signed, exiting")
+			os.Exit(1)
+		}
+
+		auth, err := NewAuthenticator(*cfg.Auth)
+		if err != nil {
+			log.Printf("error: %v, exiting", err)
+			os.Exit(1)
+		}
+
+		expires := time.Now().Add(opts.SignValid)
+		fmt.Printf("%v?expires=%d&signature=%v\n", opts.SignPath, expires.Unix(), auth.Sign(opts.SignPath, expires))
+		os.Exit(0)
+	}
+
 	// cli flags overwrite config file entries
 	if flags.Changed("enable-tls") {
 		cfg.TLSEnable = &opts.EnableTLS
@@ -115,6 +162,15 @@ func parseConfigOptions() Config {
 		cfg.TLSKeyFile = &opts.KeyFile
 	}
 
+	if flags.Changed("listen") {
+		cfg.Listen = &opts.Listen
+	}
+
+	if flags.Changed("no-socket-activation") {
+		var enable = !opts.NoSocketActivation
+		cfg.SocketActivation = &enable
+	}
+
 	if cfg.TLSEnable != nil && *cfg.TLSEnable {
 		if cfg.TLSCertificateFile == nil || *cfg.TLSCertificateFile == "" {
 			log.Printf("error: TLS enabled but --certificate not set, exiting")
@@ -136,6 +192,96 @@ func parseConfigOptions() Config {
 	return cfg
 }
 
+// defaultUpstreamQueueTimeout is the time requests wait for a free upstream
+// connection by default.
+const defaultUpstreamQueueTimeout = 30 * time.Second
+
+// upstreamQueueTimeout returns the time requests wait for a free upstream
+// connection when a limit is reached.
+func upstreamQueueTimeout(cfg Config) (time.Duration, error) {
+	if cfg.UpstreamQueueTimeout == nil {
+		return defaultUpstreamQueueTimeout, nil
+	}
+
+	timeout, err := time.ParseDuration(*cfg.UpstreamQueueTimeout)
+	if err != nil {
+		return 0, fmt.Errorf("invalid upstream_queue_timeout: %v", err)
+	}
+
+	return timeout, nil
+}
+
+// newLimiter returns the limiter for concurrent upstream requests configured
+// in cfg, or nil if no limit is set.
+func newLimiter(cfg Config, timeout time.Duration) *UpstreamLimiter {
+	if cfg.MaxConcurrentUpstream == nil && cfg.MaxConcurrentUpstreamPerHost == nil {
+		return nil
+	}
+
+	var total, perHost int
+	if cfg.MaxConcurrentUpstream != nil {
+		total = *cfg.MaxConcurrentUpstream
+	}
+
+	if cfg.MaxConcurrentUpstreamPerHost != nil {
+		perHost = *cfg.MaxConcurrentUpstreamPerHost
+	}
+
+	return NewUpstreamLimiter(total, perHost, timeout)
+}
+
+// configureHTTP2 sets up the protocols for srv: HTTP/2 is negotiated via ALPN
+// on TLS listeners unless enableHTTP2 is false, plaintext listeners accept
+// h2c (with prior knowledge or via Upgrade: h2c) only if enableH2C is set.
+func configureHTTP2(srv *http.Server, useTLS, enableHTTP2, enableH2C bool) {
+	switch {
+	case useTLS && !enableHTTP2:
+		// a non-nil map disables HTTP/2 in ServeTLS
+		srv.TLSConfig = &tls.Config{NextProtos: []string{"http/1.1"}}
+		srv.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	case !useTLS && enableH2C:
+		srv.Handler = h2c.NewHandler(srv.Handler, &http2.Server{})
+	}
+}
+
+// allowedMethods returns the HTTP methods accepted from clients configured in
+// cfg, in upper case.
+func allowedMethods(cfg Config) []string {
+	if len(cfg.AllowedMethods) == 0 {
+		return defaultAllowedMethods
+	}
+
+	methods := make([]string, 0, len(cfg.AllowedMethods))
+	for _, method := range cfg.AllowedMethods {
+		methods = append(methods, strings.ToUpper(method))
+	}
+	return methods
+}
+
+// newClientLimiter returns the limiter for requests per client configured in
+// cfg, or nil if no limit is set.
+func newClientLimiter(cfg Config) *ClientLimiter {
+	if cfg.ClientRateLimit == nil && cfg.MaxConcurrentPerClient == nil {
+		return nil
+	}
+
+	var rate float64
+	if cfg.ClientRateLimit != nil {
+		rate = *cfg.ClientRateLimit
+	}
+
+	var burst, concurrent int
+	if cfg.ClientRateBurst != nil {
+		burst = *cfg.ClientRateBurst
+	}
+
+	if cfg.MaxConcurrentPerClient != nil {
+		concurrent = *cfg.MaxConcurrentPerClient
+	}
+
+	return NewClientLimiter(rate, burst, concurrent)
+}
+
 func main() {
 	// remove timestamp from logger
 	log.SetFlags(0)
@@ -143,68 +289,499 @@ func main() {
 
 	cfg := parseConfigOptions()
 
+	log.Printf("distriproxy %v (commit %v, built %v)", version, commit, buildDate)
+
+	errorPages, err := LoadErrorPages(cfg.ErrorPages)
+	if err != nil {
+		log.Printf("error: %v, exiting", err)
+		os.Exit(1)
+	}
+
+	queueTimeout, err := upstreamQueueTimeout(cfg)
+	if err != nil {
+		log.Printf("error: %v, exiting", err)
+		os.Exit(1)
+	}
+
+	shared := &Shared{
+		ErrorPages:            errorPages,
+		Limiter:               newLimiter(cfg, queueTimeout),
+		QueueTimeout:          queueTimeout,
+		UserAgent:             productName(),
+		MaxResponseHeaders:    defaultMaxResponseHeaders,
+		FilterRequestHeaders:  headerSet(defaultFilterRequestHeaders),
+		FilterResponseHeaders: headerSet(defaultFilterResponseHeaders),
+		ResponseHeaders:       cfg.ResponseHeaders,
+	}
+
+	if cfg.FilterRequestHeaders != nil {
+		shared.FilterRequestHeaders = headerSet(cfg.FilterRequestHeaders)
+	}
+
+	if cfg.FilterResponseHeaders != nil {
+		shared.FilterResponseHeaders = headerSet(cfg.FilterResponseHeaders)
+	}
+
+	if cfg.AllowResponseHeaders != nil {
+		shared.AllowResponseHeaders = headerSet(cfg.AllowResponseHeaders)
+	}
+
+	if cfg.UserAgent != nil {
+		shared.UserAgent = *cfg.UserAgent
+	}
+
+	if cfg.ServerHeader != nil {
+		serverHeader = *cfg.ServerHeader
+	}
+
+	if cfg.LogSampleRate != nil {
+		if *cfg.LogSampleRate <= 0 || *cfg.LogSampleRate > 1 {
+			log.Printf("error: log_sample_rate must be greater than 0 and at most 1, exiting")
+			os.Exit(1)
+		}
+		shared.LogSampleRate = *cfg.LogSampleRate
+	}
+
+	if cfg.MaintenanceRetryAfter != nil {
+		shared.MaintenanceRetryAfter, err = time.ParseDuration(*cfg.MaintenanceRetryAfter)
+		if err != nil || shared.MaintenanceRetryAfter < time.Second {
+			log.Printf("error: invalid maintenance_retry_after %q, exiting", *cfg.MaintenanceRetryAfter)
+			os.Exit(1)
+		}
+	}
+
+	if cfg.Maintenance != nil && *cfg.Maintenance {
+		shared.setMaintenance(true)
+		log.Printf("maintenance mode enabled")
+	}
+	toggleMaintenanceOnSignal(shared)
+
+	if cfg.NegativeCacheTTL != nil {
+		ttl, err := time.ParseDuration(*cfg.NegativeCacheTTL)
+		if err != nil {
+			log.Printf("error: invalid negative_cache_ttl: %v, exiting", err)
+			os.Exit(1)
+		}
+		shared.NegativeCache = NewNegativeCache(ttl)
+	}
+
+	if cfg.BufferThreshold != nil {
+		shared.BufferThreshold = int64(*cfg.BufferThreshold)
+	}
+
+	if cfg.SlowRequestThreshold != nil {
+		shared.SlowRequestThreshold, err = time.ParseDuration(*cfg.SlowRequestThreshold)
+		if err != nil {
+			log.Printf("error: invalid slow_request_threshold: %v, exiting", err)
+			os.Exit(1)
+		}
+	}
+
+	if cfg.SendVia == nil || *cfg.SendVia {
+		shared.ViaPseudonym = defaultViaPseudonym()
+		if cfg.ViaPseudonym != nil {
+			shared.ViaPseudonym = *cfg.ViaPseudonym
+		}
+	}
+
+	if cfg.NodeID != nil {
+		shared.NodeID = *cfg.NodeID
+	}
+
+	if cfg.MaxResponseHeaders != nil {
+		shared.MaxResponseHeaders = *cfg.MaxResponseHeaders
+	}
+
+	if cfg.LogLevel != nil {
+		shared.LogLevel, err = ParseLogLevel(*cfg.LogLevel)
+		if err != nil {
+			log.Printf("error: %v, exiting", err)
+			os.Exit(1)
+		}
+	}
+
+	var auth *Authenticator
+	if cfg.Auth != nil {
+		auth, err = NewAuthenticator(*cfg.Auth)
+		if err != nil {
+			log.Printf("error: %v, exiting", err)
+			os.Exit(1)
+		}
+	}
+
 	mux := http.NewServeMux()
 
-	// make a copy of the default HTTP client to use by the proxy instances
-	var client = *http.DefaultClient
+	mux.HandleFunc("/version", serveVersion)
 
-	for prefix, url := range config {
-		mux.Handle(prefix+"/", NewProxy(prefix, url, &client))
+	if cfg.EnableStatus != nil && *cfg.EnableStatus {
+		shared.Status = &Status{}
+		if auth != nil {
+			mux.Handle("/status", RequireAuth(shared.Status, auth, shared))
+		} else {
+			mux.Handle("/status", shared.Status)
+		}
 	}
 
-	// install catch-all handler to log invalid requests
-	mux.HandleFunc("/", func(rw http.ResponseWriter, req *http.Request) {
-		log.Printf("%v %v %v -> 404 not found", req.RemoteAddr, req.Method, req.URL.Path)
-		rw.Header().Set("Server", "distriproxy")
-		rw.WriteHeader(http.StatusNotFound)
-	})
+	clients := newClientFactory(cfg)
+
+	// pass proxy requests for configured upstreams and allowed hosts to the
+	// forward proxy
+	var forward *ForwardProxy
+	if cfg.AllowForwardProxy != nil && *cfg.AllowForwardProxy {
+		client, err := clients.clientFor(Path{Path: "forward"})
+		if err != nil {
+			log.Printf("error: %v, exiting", err)
+			os.Exit(1)
+		}
 
-	srv := http.Server{
-		Handler: RejectProxyRequests(mux),
+		forward = NewForwardProxy(cfg.ForwardProxyHosts, client, auth, shared)
 	}
 
-	var listener net.Listener
+	defaultUpstream := false
+	var checks []upstreamCheck
+	for _, path := range cfg.Paths {
+		client, err := clients.clientFor(path)
+		if err != nil {
+			log.Printf("error: %v, exiting", err)
+			os.Exit(1)
+		}
 
-	// try systemd socket activation first
-	listeners, err := activation.Listeners()
-	if err != nil {
-		panic(err)
+		proxy, err := NewProxy(path, client, shared)
+		if err != nil {
+			log.Printf("error: %v, exiting", err)
+			os.Exit(1)
+		}
+
+		// the forward proxy checks the credentials itself, so it gets the
+		// handler without RequireAuth
+		requireAuth := auth != nil && (path.RequireAuth == nil || *path.RequireAuth)
+		pathHandler := proxy
+		if requireAuth {
+			pathHandler = RequireAuth(proxy, auth, shared)
+		}
+
+		// the more specific paths take precedence over a path "/" in the mux
+		prefix := pathPrefix(path.Path)
+		mux.Handle(prefix+"/", pathHandler)
+		if prefix == "" {
+			defaultUpstream = true
+		}
+
+		if forward != nil {
+			// map proxy requests for the upstream URL back to the path,
+			// reversing strip_prefix and add_prefix
+			upstream := strings.TrimRight(path.URL, "/") + normalizePrefix(stringValue(path.AddPrefix))
+			local := prefix + normalizePrefix(stringValue(path.StripPrefix))
+			err = forward.AddRoute(upstream, local, proxy, requireAuth)
+			if err != nil {
+				log.Printf("error: path %v: %v, exiting", path.Path, err)
+				os.Exit(1)
+			}
+		}
+
+		checks = append(checks, upstreamCheck{path: path, client: client})
+	}
+
+	// no upstream server is contacted in maintenance mode
+	if cfg.VerifyUpstreams != nil && *cfg.VerifyUpstreams && !shared.inMaintenance() {
+		verifyUpstreams(checks, shared.UserAgent)
+
+		for _, c := range checks {
+			if c.err != nil {
+				log.Printf("upstream %v for %v is unreachable: %v", c.path.URL, c.path.Path, c.err)
+				if cfg.FailOnUnreachable != nil && *cfg.FailOnUnreachable {
+					log.Printf("error: upstream unreachable, exiting")
+					os.Exit(1)
+				}
+				continue
+			}
+
+			log.Printf("upstream %v for %v is reachable: %v", c.path.URL, c.path.Path, c.status)
+		}
+	}
+
+	// install catch-all handler to log invalid requests, the body makes it
+	// distinguishable from a 404 passed on from an upstream server
+	if !defaultUpstream {
+		mux.HandleFunc("/", func(rw http.ResponseWriter, req *http.Request) {
+			e := errNotFound("%v %v %v -> 404 path not proxied", clientIP(req), req.Method, req.URL.Path)
+			e.Message = "path not proxied here\n"
+			shared.writeError(rw, req, "", e)
+		})
+	}
+
+	// a nil *ForwardProxy must not be passed as a non-nil http.Handler
+	var forwardHandler http.Handler
+	if forward != nil {
+		forwardHandler = forward
+	}
+
+	handler := RejectProxyRequests(mux, forwardHandler, allowedMethods(cfg), shared)
+
+	robotsTxt := []byte(defaultRobotsTxt)
+	if cfg.RobotsTxtFile != nil {
+		robotsTxt, err = ioutil.ReadFile(*cfg.RobotsTxtFile)
+		if err != nil {
+			log.Printf("error: loading robots_txt_file failed: %v, exiting", err)
+			os.Exit(1)
+		}
+	}
+
+	var bots *regexp.Regexp
+	if cfg.BlockUserAgents != nil {
+		bots, err = regexp.Compile(*cfg.BlockUserAgents)
+		if err != nil {
+			log.Printf("error: invalid block_user_agents: %v, exiting", err)
+			os.Exit(1)
+		}
 	}
 
-	switch len(listeners) {
-	case 0:
-		// no listeners found, listen manually
-		listener, err = net.Listen("tcp", ":8080")
+	handler = Robots(handler, robotsTxt, bots, shared)
+
+	var maxRequestDuration time.Duration
+	if cfg.MaxRequestDuration != nil {
+		maxRequestDuration, err = time.ParseDuration(*cfg.MaxRequestDuration)
+		if err != nil {
+			log.Printf("error: invalid max_request_duration: %v, exiting", err)
+			os.Exit(1)
+		}
+		handler = LimitDuration(handler, maxRequestDuration)
+	}
+
+	if shared.NodeID != "" {
+		handler = DetectLoops(handler, shared.NodeID, shared)
+	}
+
+	if clientLimiter := newClientLimiter(cfg); clientLimiter != nil {
+		handler = LimitClients(handler, clientLimiter, shared)
+	}
+
+	maxRequestHeaders := defaultMaxRequestHeaders
+	if cfg.MaxRequestHeaders != nil {
+		maxRequestHeaders = *cfg.MaxRequestHeaders
+	}
+
+	if maxRequestHeaders > 0 {
+		handler = LimitHeaders(handler, maxRequestHeaders, shared)
+	}
+
+	maxHeaderBytes := defaultMaxHeaderBytes
+	if cfg.MaxHeaderBytes != nil {
+		maxHeaderBytes = *cfg.MaxHeaderBytes
+	}
+
+	var accessLogFile *LogFile
+	if cfg.AccessLogFile != nil {
+		size := defaultAccessLogBufferSize
+		if cfg.AccessLogBufferSize != nil {
+			size = *cfg.AccessLogBufferSize
+		}
+
+		interval := defaultAccessLogFlushInterval
+		if cfg.AccessLogFlushInterval != nil {
+			interval, err = time.ParseDuration(*cfg.AccessLogFlushInterval)
+			if err != nil || interval <= 0 {
+				log.Printf("error: invalid access_log_flush_interval %q, exiting", *cfg.AccessLogFlushInterval)
+				os.Exit(1)
+			}
+		}
+
+		compress := cfg.AccessLogCompress != nil && *cfg.AccessLogCompress
+		accessLogFile, err = OpenLogFile(*cfg.AccessLogFile, size, compress)
+		if err != nil {
+			log.Printf("error: opening access_log_file failed: %v, exiting", err)
+			os.Exit(1)
+		}
+		accessLogFile.flushEvery(interval)
+		accessLogFile.reopenOnSignal()
+	}
+
+	if cfg.LogFormat != nil && *cfg.LogFormat != "" {
+		var wr io.Writer = os.Stdout
+		if accessLogFile != nil {
+			wr = accessLogFile
+		}
+
+		handler, err = AccessLog(handler, *cfg.LogFormat, wr)
 		if err != nil {
-			log.Printf("unable to bind to port: %v", err)
+			log.Printf("error: %v, exiting", err)
 			os.Exit(1)
 		}
+	}
 
-		log.Printf("listening on %v (TLS %v)", listener.Addr(), *cfg.TLSEnable)
-	case 1:
-		// one listener supplied by systemd, use that one
-		listener = listeners[0]
-		log.Printf("listening on %v via systemd socket activation (TLS %v)", listener.Addr(), *cfg.TLSEnable)
-	default:
-		log.Printf("got %d listeners, expected one", len(listeners))
+	if len(cfg.TrustedProxies) > 0 {
+		nets, err := parseCIDRs(cfg.TrustedProxies)
+		if err != nil {
+			log.Printf("error: invalid trusted_proxies: %v, exiting", err)
+			os.Exit(1)
+		}
+
+		handler = RealIP(handler, nets)
+	}
+
+	endpoints, err := getEndpoints(cfg)
+	if err != nil {
+		log.Printf("error: %v, exiting", err)
 		os.Exit(1)
 	}
 
-	done := gracefulShutdown(&srv)
-	if *cfg.TLSEnable {
-		err = srv.ServeTLS(listener, *cfg.TLSCertificateFile, *cfg.TLSKeyFile)
-	} else {
-		err = srv.Serve(listener)
+	var socketMode os.FileMode
+	if cfg.ListenSocketMode != nil {
+		mode, err := strconv.ParseUint(*cfg.ListenSocketMode, 8, 32)
+		if err != nil {
+			log.Printf("error: invalid listen_socket_mode: %v, exiting", err)
+			os.Exit(1)
+		}
+		socketMode = os.FileMode(mode)
 	}
-	if err == http.ErrServerClosed {
-		log.Printf("waiting for graceful shutdown")
-		<-done
-		log.Printf("shutdown completed")
-		err = nil
+
+	socketActivation := cfg.SocketActivation == nil || *cfg.SocketActivation
+
+	addresses := make([]string, 0, len(endpoints))
+	for _, ep := range endpoints {
+		addresses = append(addresses, ep.Address)
+	}
+
+	// during a graceful restart, the listeners are passed in by the previous
+	// process, see restartOnSignal
+	inherited, err := inheritedListeners()
+	if err != nil {
+		log.Printf("error: %v, exiting", err)
+		os.Exit(1)
 	}
 
+	// the inherited listeners are matched by address, the config may have
+	// changed since the previous process was started
+	var listeners []net.Listener
+	var activated bool
+	var taken []bool
+	if inherited != nil {
+		listeners, taken, err = takeOverListeners(&inherited, addresses, socketMode)
+	} else {
+		listeners, activated, err = getListeners(addresses, socketMode, socketActivation, activation.Listeners)
+	}
 	if err != nil {
-		log.Printf("Serve returned error: %v", err)
+		log.Printf("%v, exiting", err)
 		os.Exit(1)
 	}
+
+	enableHTTP2 := cfg.HTTP2 == nil || *cfg.HTTP2
+	enableH2C := cfg.H2C != nil && *cfg.H2C
+
+	servers := make([]*http.Server, 0, len(endpoints))
+	for i, ep := range endpoints {
+		srv := &http.Server{
+			Handler:        handler,
+			MaxHeaderBytes: maxHeaderBytes,
+			WriteTimeout:   maxRequestDuration,
+		}
+
+		if ep.RedirectHTTPS {
+			port, err := httpsPort(endpoints)
+			if err != nil {
+				log.Printf("error: %v, exiting", err)
+				os.Exit(1)
+			}
+			srv.Handler = redirectHTTPS(port)
+		}
+
+		configureHTTP2(srv, ep.TLS, enableHTTP2, enableH2C)
+		servers = append(servers, srv)
+
+		switch {
+		case taken != nil && taken[i]:
+			log.Printf("listening on %v, taken over from the previous process (TLS %v)", listeners[i].Addr(), ep.TLS)
+		case activated:
+			log.Printf("listening on %v via systemd socket activation (TLS %v)", listeners[i].Addr(), ep.TLS)
+		default:
+			log.Printf("listening on %v (TLS %v)", listeners[i].Addr(), ep.TLS)
+		}
+	}
+
+	adminMux := http.NewServeMux()
+	if cfg.EnablePprof != nil && *cfg.EnablePprof {
+		if cfg.AdminListen == nil {
+			log.Printf("error: enable_pprof requires admin_listen, exiting")
+			os.Exit(1)
+		}
+		registerPprof(adminMux)
+	}
+
+	adminMux.Handle("/admin/routes", NewRoutes(cfg))
+
+	if shared.NegativeCache != nil {
+		adminMux.HandleFunc("/admin/purge-negative-cache", shared.servePurgeNegativeCache)
+	}
+
+	if cfg.AdminListen != nil {
+		if cfg.AdminToken == nil || *cfg.AdminToken == "" {
+			log.Printf("error: admin_listen requires admin_token, exiting")
+			os.Exit(1)
+		}
+
+		adminHandler, err := AdminHandler(adminMux, *cfg.AdminToken, shared)
+		if err != nil {
+			log.Printf("error: %v, exiting", err)
+			os.Exit(1)
+		}
+
+		listener := takeListener(&inherited, *cfg.AdminListen)
+		if listener == nil {
+			listener, err = listenOn(*cfg.AdminListen, socketMode)
+			if err != nil {
+				log.Printf("unable to bind to %v: %v, exiting", *cfg.AdminListen, err)
+				os.Exit(1)
+			}
+		}
+
+		log.Printf("admin interface listening on %v", listener.Addr())
+
+		servers = append(servers, &http.Server{Handler: adminHandler})
+		listeners = append(listeners, listener)
+		endpoints = append(endpoints, endpoint{Address: *cfg.AdminListen})
+	}
+
+	// listeners of the previous process which are not configured any more
+	for _, listener := range inherited {
+		log.Printf("closing %v, taken over from the previous process but not configured", listener.Addr())
+		_ = listener.Close()
+	}
+
+	restart := restartOnSignal(listeners)
+	done := gracefulShutdown(servers, restart)
+
+	errs := make(chan error, len(servers))
+	for i := range servers {
+		srv, listener, ep := servers[i], listeners[i], endpoints[i]
+		go func() {
+			if ep.TLS {
+				errs <- srv.ServeTLS(listener, *cfg.TLSCertificateFile, *cfg.TLSKeyFile)
+			} else {
+				errs <- srv.Serve(listener)
+			}
+		}()
+	}
+
+	// the listeners are in use, a previous process can shut down now
+	notifyReady()
+
+	for range servers {
+		err := <-errs
+		if err != http.ErrServerClosed {
+			log.Printf("Serve returned error: %v", err)
+			os.Exit(1)
+		}
+	}
+
+	log.Printf("waiting for graceful shutdown")
+	<-done
+
+	if accessLogFile != nil {
+		err := accessLogFile.Close()
+		if err != nil {
+			log.Printf("closing access_log_file failed: %v", err)
+		}
+	}
+
+	log.Printf("shutdown completed")
 }
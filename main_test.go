@@ -0,0 +1,433 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// mainHelperEnv contains the arguments for the process started by runMain,
+// separated by newlines.
+const mainHelperEnv = "DISTRIPROXY_TEST_MAIN_HELPER"
+
+// TestMainHelper is run as a new process by runMain, it calls main with the
+// arguments from the environment.
+func TestMainHelper(t *testing.T) {
+	args := os.Getenv(mainHelperEnv)
+	if args == "" {
+		t.Skip("only run as a new process by runMain")
+	}
+
+	os.Args = append([]string{"distriproxy"}, strings.Split(args, "\n")...)
+	main()
+}
+
+// mainCommand returns the command which runs main with args.
+func mainCommand(args ...string) *exec.Cmd {
+	cmd := exec.Command(os.Args[0], "-test.run=^TestMainHelper$")
+	cmd.Env = append(os.Environ(), mainHelperEnv+"="+strings.Join(args, "\n"))
+	return cmd
+}
+
+// freeAddress returns a local address which is currently not in use.
+func freeAddress(t *testing.T) string {
+	t.Helper()
+
+	l := listen(t, "tcp", "127.0.0.1:0")
+	address := l.Addr().String()
+	_ = l.Close()
+	return address
+}
+
+// runMain starts main with the config in a new process and waits until it
+// accepts connections on all addresses. The returned function stops the
+// process and returns its output.
+func runMain(t *testing.T, config string, addresses ...string) func() string {
+	t.Helper()
+
+	dir, cleanup := tempDir(t)
+
+	filename := filepath.Join(dir, "distriproxy.conf")
+	err := ioutil.WriteFile(filename, []byte(config), 0644)
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+
+	output := &syncBuffer{}
+	cmd := mainCommand("--no-socket-activation", "--config", filename)
+	cmd.Stdout = output
+	cmd.Stderr = output
+
+	err = cmd.Start()
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+
+	stop := func() string {
+		_ = cmd.Process.Signal(syscall.SIGTERM)
+		_ = cmd.Wait()
+		cleanup()
+		return output.String()
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for _, address := range addresses {
+		for {
+			conn, err := net.Dial("tcp", address)
+			if err == nil {
+				_ = conn.Close()
+				break
+			}
+
+			if time.Now().After(deadline) {
+				t.Fatalf("%v not reachable: %v\n%s", address, err, stop())
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+
+	return stop
+}
+
+func TestMainVersion(t *testing.T) {
+	output, err := mainCommand("--version").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := fmt.Sprintf("distriproxy %v\ncommit %v\nbuilt %v\n", version, commit, buildDate)
+	if string(output) != want {
+		t.Fatalf("wrong output, want:\n%s\ngot:\n%s", want, output)
+	}
+}
+
+func TestAdminListener(t *testing.T) {
+	upstream := echoRequest()
+	defer upstream.Close()
+
+	public := freeAddress(t)
+	admin := freeAddress(t)
+
+	config := fmt.Sprintf(`
+listen = %q
+admin_listen = %q
+admin_token = "secret"
+enable_pprof = true
+log_level = "error"
+
+path "/debian" {
+  url = %q
+}
+`, public, admin, upstream.URL)
+
+	stop := runMain(t, config, public, admin)
+	defer func() {
+		output := stop()
+		if t.Failed() {
+			t.Logf("output:\n%s", output)
+		}
+	}()
+
+	var tests = []struct {
+		address string
+		path    string
+		token   string
+		status  int
+		body    string
+	}{
+		{public, "/debian/x", "", http.StatusOK, "GET /x "},
+		{public, "/debug/pprof/", "", http.StatusNotFound, "path not proxied here\n"},
+		{public, "/debug/pprof/cmdline", "secret", http.StatusNotFound, "path not proxied here\n"},
+		{public, "/admin/routes", "", http.StatusNotFound, "path not proxied here\n"},
+		{public, "/admin/routes", "secret", http.StatusNotFound, "path not proxied here\n"},
+		{admin, "/debug/pprof/", "", http.StatusUnauthorized, ""},
+		{admin, "/debug/pprof/", "wrong", http.StatusUnauthorized, ""},
+		{admin, "/debug/pprof/", "secret", http.StatusOK, "goroutine"},
+		{admin, "/debug/pprof/cmdline", "secret", http.StatusOK, "--no-socket-activation"},
+		{admin, "/admin/routes", "", http.StatusUnauthorized, ""},
+		{admin, "/admin/routes", "secret", http.StatusOK, `"/debian"`},
+		{admin, "/debian/x", "secret", http.StatusNotFound, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.address+test.path, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, "http://"+test.address+test.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if test.token != "" {
+				req.Header.Set("Authorization", "Bearer "+test.token)
+			}
+
+			res, body := do(t, http.DefaultClient, req)
+			if res.StatusCode != test.status {
+				t.Fatalf("wrong status, want %v, got %v", test.status, res.Status)
+			}
+
+			if !strings.Contains(body, test.body) {
+				t.Fatalf("body does not contain %q: %q", test.body, body)
+			}
+		})
+	}
+}
+
+func TestAdminHandler(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/x", func(rw http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(rw, "ok\n")
+	})
+
+	handler, err := AdminHandler(mux, "secret", &Shared{LogLevel: LogError})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	for _, token := range []string{"", "secre", "secret2", "Secret"} {
+		req, err := http.NewRequest(http.MethodGet, srv.URL+"/admin/x", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		res, _ := do(t, http.DefaultClient, req)
+		if res.StatusCode != http.StatusUnauthorized {
+			t.Errorf("wrong status for token %q: %v", token, res.Status)
+		}
+	}
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/admin/x", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer secret")
+
+	res, body := do(t, http.DefaultClient, req)
+	if res.StatusCode != http.StatusOK || body != "ok\n" {
+		t.Fatalf("unexpected response %v %q", res.Status, body)
+	}
+}
+
+func TestAllowedMethods(t *testing.T) {
+	var tests = []struct {
+		methods []string
+		want    []string
+	}{
+		{nil, []string{"GET", "HEAD"}},
+		{[]string{}, []string{"GET", "HEAD"}},
+		{[]string{"get", "Head", "OPTIONS"}, []string{"GET", "HEAD", "OPTIONS"}},
+		{[]string{"GET"}, []string{"GET"}},
+	}
+
+	for _, test := range tests {
+		got := allowedMethods(Config{AllowedMethods: test.methods})
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("wrong methods for %q, want %q, got %q", test.methods, test.want, got)
+		}
+	}
+}
+
+// newTestCertificate returns a self-signed certificate for 127.0.0.1 and the
+// certificate in PEM encoding.
+func newTestCertificate(t *testing.T) (tls.Certificate, []byte) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "distriproxy test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	return cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+// certPool returns a pool containing the PEM encoded certificate.
+func certPool(t *testing.T, certPEM []byte) *x509.CertPool {
+	t.Helper()
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(certPEM) {
+		t.Fatal("invalid certificate")
+	}
+	return pool
+}
+
+// h2cUpgrade sends a request with Upgrade: h2c to address and returns the
+// status line of the response.
+func h2cUpgrade(t *testing.T, address string) string {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "GET /proto HTTP/1.1\r\nHost: %v\r\nConnection: Upgrade, HTTP2-Settings\r\n"+
+		"Upgrade: h2c\r\nHTTP2-Settings: AAMAAABkAARAAAAAAAIAAAAA\r\n\r\n", address)
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return strings.TrimSpace(line)
+}
+
+func TestConfigureHTTP2(t *testing.T) {
+	cert, certPEM := newTestCertificate(t)
+	tlsConfig := &tls.Config{RootCAs: certPool(t, certPEM)}
+
+	http1Client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: tlsConfig,
+		TLSNextProto:    make(map[string]func(string, *tls.Conn) http.RoundTripper),
+	}}
+
+	h2Client := &http.Client{Transport: &http2.Transport{TLSClientConfig: tlsConfig}}
+
+	h2cClient := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, address string, cfg *tls.Config) (net.Conn, error) {
+			return net.Dial(network, address)
+		},
+	}}
+
+	var tests = []struct {
+		name        string
+		useTLS      bool
+		enableHTTP2 bool
+		enableH2C   bool
+
+		http1   string
+		http2   string
+		upgrade string
+	}{
+		{"tls", true, true, false, "HTTP/1.1", "HTTP/2.0", ""},
+		{"tls-http2-disabled", true, false, false, "HTTP/1.1", "", ""},
+		{"tls-h2c-enabled", true, true, true, "HTTP/1.1", "HTTP/2.0", ""},
+		{"plain", false, true, false, "HTTP/1.1", "", "HTTP/1.1 200 OK"},
+		{"plain-h2c", false, true, true, "HTTP/1.1", "HTTP/2.0", "HTTP/1.1 101 Switching Protocols"},
+		{"plain-h2c-http2-disabled", false, false, true, "HTTP/1.1", "HTTP/2.0", "HTTP/1.1 101 Switching Protocols"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srv := &http.Server{Handler: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				fmt.Fprint(rw, req.Proto)
+			})}
+			configureHTTP2(srv, test.useTLS, test.enableHTTP2, test.enableH2C)
+
+			listener := listen(t, "tcp", "127.0.0.1:0")
+			address := listener.Addr().String()
+			scheme := "http"
+			if test.useTLS {
+				scheme = "https"
+				if srv.TLSConfig == nil {
+					srv.TLSConfig = &tls.Config{}
+				}
+				srv.TLSConfig.Certificates = []tls.Certificate{cert}
+				go func() {
+					_ = srv.ServeTLS(listener, "", "")
+				}()
+			} else {
+				go func() {
+					_ = srv.Serve(listener)
+				}()
+			}
+			defer func() {
+				_ = srv.Close()
+			}()
+
+			url := scheme + "://" + address + "/proto"
+
+			req, err := http.NewRequest(http.MethodGet, url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			res, body := do(t, http1Client, req)
+			if res.ProtoMajor != 1 || body != test.http1 {
+				t.Errorf("wrong protocol for HTTP/1.1 client: %v %q", res.Proto, body)
+			}
+
+			client := h2cClient
+			if test.useTLS {
+				client = h2Client
+			}
+
+			res, err = client.Get(url)
+			switch {
+			case test.http2 == "" && err == nil:
+				_ = res.Body.Close()
+				t.Errorf("HTTP/2 request was accepted with %v", res.Proto)
+			case test.http2 != "" && err != nil:
+				t.Errorf("HTTP/2 request failed: %v", err)
+			case test.http2 != "":
+				buf, err := ioutil.ReadAll(res.Body)
+				_ = res.Body.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if res.Proto != test.http2 || string(buf) != test.http2 {
+					t.Errorf("wrong protocol for HTTP/2 client: %v %q", res.Proto, buf)
+				}
+			}
+
+			if test.upgrade != "" {
+				if line := h2cUpgrade(t, address); line != test.upgrade {
+					t.Errorf("wrong response to Upgrade: h2c, want %q, got %q", test.upgrade, line)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// defaultMaintenanceRetryAfter is sent in the Retry-After header of requests
+// answered with 503 in maintenance mode.
+const defaultMaintenanceRetryAfter = 5 * time.Minute
+
+// inMaintenance reports whether maintenance mode is enabled, no upstream
+// requests are sent then.
+func (s *Shared) inMaintenance() bool {
+	return atomic.LoadInt32(&s.maintenance) != 0
+}
+
+// setMaintenance enables or disables maintenance mode.
+func (s *Shared) setMaintenance(enable bool) {
+	var v int32
+	if enable {
+		v = 1
+	}
+	atomic.StoreInt32(&s.maintenance, v)
+}
+
+// retryAfterMaintenance returns the value for the Retry-After header in
+// maintenance mode.
+func (s *Shared) retryAfterMaintenance() string {
+	d := s.MaintenanceRetryAfter
+	if d <= 0 {
+		d = defaultMaintenanceRetryAfter
+	}
+	return strconv.Itoa(int(d.Round(time.Second) / time.Second))
+}
+
+// toggleMaintenanceOnSignal switches maintenance mode on and off each time
+// SIGUSR1 is received.
+func toggleMaintenanceOnSignal(s *Shared) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1)
+
+	go func() {
+		for range ch {
+			enable := !s.inMaintenance()
+			s.setMaintenance(enable)
+			log.Printf("received SIGUSR1, maintenance mode %v", enable)
+		}
+	}()
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRetryAfterMaintenance(t *testing.T) {
+	var tests = []struct {
+		retryAfter time.Duration
+		want       string
+	}{
+		{0, "300"},
+		{time.Second, "1"},
+		{90 * time.Second, "90"},
+		{1500 * time.Millisecond, "2"},
+		{2 * time.Hour, "7200"},
+	}
+
+	for _, test := range tests {
+		shared := &Shared{MaintenanceRetryAfter: test.retryAfter}
+		if got := shared.retryAfterMaintenance(); got != test.want {
+			t.Errorf("wrong Retry-After for %v, want %q, got %q", test.retryAfter, test.want, got)
+		}
+	}
+}
+
+func TestProxyMaintenance(t *testing.T) {
+	var requests int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		fmt.Fprint(rw, "upstream\n")
+	}))
+	defer upstream.Close()
+
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	err := ioutil.WriteFile(filepath.Join(dir, "Release"), []byte("local\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shared := &Shared{LogLevel: LogError, MaintenanceRetryAfter: 2 * time.Minute}
+
+	mux := http.NewServeMux()
+	for _, path := range []Path{
+		{Path: "/debian", URL: upstream.URL},
+		{Path: "/local", URL: "file://" + dir},
+	} {
+		proxy, err := NewProxy(path, nil, shared)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mux.Handle(path.Path+"/", proxy)
+	}
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	var tests = []struct {
+		name        string
+		maintenance bool
+		path        string
+		status      int
+		retryAfter  string
+		body        string
+	}{
+		{"upstream", true, "/debian/dists/buster/Release", http.StatusServiceUnavailable, "120", "service unavailable, try again later\n"},
+		{"upstream-pool", true, "/debian/pool/x.deb", http.StatusServiceUnavailable, "120", "service unavailable, try again later\n"},
+		{"file", true, "/local/Release", http.StatusOK, "", "local\n"},
+		{"file-missing", true, "/local/InRelease", http.StatusNotFound, "", "not found\n"},
+		{"disabled-upstream", false, "/debian/dists/buster/Release", http.StatusOK, "", "upstream\n"},
+		{"disabled-file", false, "/local/Release", http.StatusOK, "", "local\n"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			shared.setMaintenance(test.maintenance)
+			before := atomic.LoadInt32(&requests)
+
+			res, body := get(t, srv.URL+test.path)
+			if res.StatusCode != test.status {
+				t.Errorf("wrong status, want %v, got %v", test.status, res.Status)
+			}
+
+			if res.Header.Get("Retry-After") != test.retryAfter {
+				t.Errorf("wrong Retry-After, want %q, got %q", test.retryAfter, res.Header.Get("Retry-After"))
+			}
+
+			if body != test.body {
+				t.Errorf("wrong body, want %q, got %q", test.body, body)
+			}
+
+			if test.maintenance && atomic.LoadInt32(&requests) != before {
+				t.Errorf("upstream server contacted in maintenance mode")
+			}
+		})
+	}
+}
+
+func TestToggleMaintenanceOnSignal(t *testing.T) {
+	shared := &Shared{}
+	toggleMaintenanceOnSignal(shared)
+
+	for _, want := range []bool{true, false} {
+		err := syscall.Kill(os.Getpid(), syscall.SIGUSR1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		deadline := time.Now().Add(5 * time.Second)
+		for shared.inMaintenance() != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("maintenance mode not toggled to %v", want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
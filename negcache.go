@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxNegativeEntries bounds the number of entries in the negative cache.
+const maxNegativeEntries = 10000
+
+// NegativeCache remembers URLs for which the upstream server answered with
+// 404 or 410 for a short time, so that repeated requests (e.g. apt probing
+// for optional index files) are answered without contacting the upstream
+// server. A nil *NegativeCache does not cache anything.
+type NegativeCache struct {
+	ttl time.Duration
+
+	// now returns the current time, it can be replaced in tests
+	now func() time.Time
+
+	m       sync.Mutex
+	entries map[string]negativeEntry
+}
+
+type negativeEntry struct {
+	status  int
+	expires time.Time
+}
+
+// NewNegativeCache returns a negative cache which keeps entries for ttl.
+func NewNegativeCache(ttl time.Duration) *NegativeCache {
+	return &NegativeCache{
+		ttl:     ttl,
+		now:     time.Now,
+		entries: make(map[string]negativeEntry),
+	}
+}
+
+// Get returns the cached status for the URL, if any.
+func (c *NegativeCache) Get(url string) (status int, ok bool) {
+	if c == nil {
+		return 0, false
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	entry, ok := c.entries[url]
+	if !ok {
+		return 0, false
+	}
+
+	if c.now().After(entry.expires) {
+		delete(c.entries, url)
+		return 0, false
+	}
+
+	return entry.status, true
+}
+
+// Add remembers the status (404 or 410) for the URL. When the cache is full,
+// expired entries are removed, if that does not help the entry is not added.
+func (c *NegativeCache) Add(url string, status int) {
+	if c == nil {
+		return
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	now := c.now()
+	if len(c.entries) >= maxNegativeEntries {
+		for u, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, u)
+			}
+		}
+
+		if len(c.entries) >= maxNegativeEntries {
+			return
+		}
+	}
+
+	c.entries[url] = negativeEntry{status: status, expires: now.Add(c.ttl)}
+}
+
+// Purge removes all entries and returns the number of entries removed.
+func (c *NegativeCache) Purge() int {
+	if c == nil {
+		return 0
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	n := len(c.entries)
+	c.entries = make(map[string]negativeEntry)
+	return n
+}
+
+// servePurgeNegativeCache removes all entries from the negative cache for POST
+// requests.
+func (s *Shared) servePurgeNegativeCache(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		rw.Header().Set("Allow", http.MethodPost)
+		s.writeError(rw, req, "", errMethodNotAllowed("%v reject invalid method %v for %v", clientIP(req), req.Method, req.URL.Path))
+		return
+	}
+
+	n := s.NegativeCache.Purge()
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(rw, "removed %d entries\n", n)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testClock is a clock which only advances when told to.
+type testClock struct {
+	m   sync.Mutex
+	now time.Time
+}
+
+func newTestClock() *testClock {
+	return &testClock{now: time.Date(2019, 9, 16, 12, 0, 0, 0, time.UTC)}
+}
+
+func (c *testClock) Now() time.Time {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.now
+}
+
+func (c *testClock) Advance(d time.Duration) {
+	c.m.Lock()
+	c.now = c.now.Add(d)
+	c.m.Unlock()
+}
+
+func TestNegativeCache(t *testing.T) {
+	clock := newTestClock()
+	c := NewNegativeCache(time.Minute)
+	c.now = clock.Now
+
+	const url = "https://deb.debian.org/debian/dists/buster/main/i18n/Translation-de"
+
+	if _, ok := c.Get(url); ok {
+		t.Fatal("empty cache returned an entry")
+	}
+
+	c.Add(url, http.StatusNotFound)
+	c.Add(url+".xz", http.StatusGone)
+
+	var tests = []struct {
+		advance time.Duration
+		url     string
+		status  int
+		ok      bool
+	}{
+		{0, url, http.StatusNotFound, true},
+		{0, url + ".xz", http.StatusGone, true},
+		{0, url + ".gz", 0, false},
+		{59 * time.Second, url, http.StatusNotFound, true},
+		{time.Second, url, http.StatusNotFound, true},
+		{time.Nanosecond, url, 0, false},
+		{0, url + ".xz", 0, false},
+	}
+
+	for i, test := range tests {
+		clock.Advance(test.advance)
+
+		status, ok := c.Get(test.url)
+		if ok != test.ok || status != test.status {
+			t.Fatalf("test %d: wrong result for %v, want %v %v, got %v %v", i, test.url, test.status, test.ok, status, ok)
+		}
+	}
+
+	if len(c.entries) != 0 {
+		t.Fatalf("expired entries not removed: %v", c.entries)
+	}
+}
+
+func TestNegativeCacheFull(t *testing.T) {
+	clock := newTestClock()
+	c := NewNegativeCache(time.Minute)
+	c.now = clock.Now
+
+	for i := 0; i < maxNegativeEntries; i++ {
+		c.Add(strconv.Itoa(i), http.StatusNotFound)
+	}
+
+	c.Add("new", http.StatusNotFound)
+	if _, ok := c.Get("new"); ok {
+		t.Fatal("entry added to a full cache")
+	}
+
+	// once the entries have expired, they make room for new ones
+	clock.Advance(time.Hour)
+	c.Add("new", http.StatusNotFound)
+	if _, ok := c.Get("new"); !ok {
+		t.Fatal("entry not added after the old entries have expired")
+	}
+
+	if len(c.entries) != 1 {
+		t.Fatalf("wrong number of entries, want 1, got %d", len(c.entries))
+	}
+
+	if n := c.Purge(); n != 1 {
+		t.Fatalf("wrong number of entries purged, want 1, got %d", n)
+	}
+
+	if _, ok := c.Get("new"); ok {
+		t.Fatal("entry found after purge")
+	}
+}
+
+func TestNegativeCacheNil(t *testing.T) {
+	var c *NegativeCache
+	c.Add("x", http.StatusNotFound)
+
+	if _, ok := c.Get("x"); ok {
+		t.Fatal("nil cache returned an entry")
+	}
+
+	if c.Purge() != 0 {
+		t.Fatal("nil cache purged entries")
+	}
+}
+
+func TestProxyNegativeCache(t *testing.T) {
+	var m sync.Mutex
+	requests := make(map[string]int)
+
+	// the upstream server answers with the status in the file name
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		m.Lock()
+		requests[req.URL.Path]++
+		m.Unlock()
+
+		status, err := strconv.Atoi(strings.TrimPrefix(req.URL.Path, "/"))
+		if err != nil {
+			status = http.StatusInternalServerError
+		}
+		rw.WriteHeader(status)
+		fmt.Fprintf(rw, "upstream %d\n", status)
+	}))
+	defer upstream.Close()
+
+	clock := newTestClock()
+	cache := NewNegativeCache(time.Minute)
+	cache.now = clock.Now
+
+	srv := newTestProxyShared(t, Path{Path: "/debian", URL: upstream.URL}, &Shared{LogLevel: LogError, NegativeCache: cache})
+	defer srv.Close()
+
+	var tests = []struct {
+		status   int
+		requests int
+	}{
+		{http.StatusNotFound, 1},
+		{http.StatusGone, 1},
+		{http.StatusOK, 3},
+		{http.StatusForbidden, 3},
+		{http.StatusInternalServerError, 3},
+		{http.StatusServiceUnavailable, 3},
+	}
+
+	for _, test := range tests {
+		t.Run(strconv.Itoa(test.status), func(t *testing.T) {
+			path := "/" + strconv.Itoa(test.status)
+			for i := 0; i < 3; i++ {
+				res, _ := get(t, srv.URL+"/debian"+path)
+				if res.StatusCode != test.status {
+					t.Fatalf("request %d: wrong status, want %v, got %v", i, test.status, res.StatusCode)
+				}
+			}
+
+			m.Lock()
+			n := requests[path]
+			m.Unlock()
+
+			if n != test.requests {
+				t.Fatalf("wrong number of upstream requests, want %d, got %d", test.requests, n)
+			}
+		})
+	}
+
+	// after the entry has expired, the upstream server is asked again
+	clock.Advance(2 * time.Minute)
+	res, _ := get(t, srv.URL+"/debian/404")
+	if res.StatusCode != http.StatusNotFound {
+		t.Fatalf("wrong status, want %v, got %v", http.StatusNotFound, res.StatusCode)
+	}
+
+	m.Lock()
+	n := requests["/404"]
+	m.Unlock()
+
+	if n != 2 {
+		t.Fatalf("wrong number of upstream requests after expiry, want 2, got %d", n)
+	}
+}
@@ -1,36 +1,58 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"math/rand"
 	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
+	"golang.org/x/crypto/openpgp"
 	"golang.org/x/net/context/ctxhttp"
 )
 
+// defaultAllowedMethods are the HTTP methods accepted when allowed_methods is
+// not configured.
+var defaultAllowedMethods = []string{http.MethodGet, http.MethodHead}
+
 // RejectProxyRequests rejects requests which are detected as proxy requests or
-// have HTTP methods other than GET/HEAD. For all other requests, the handler
-// next is called.
-func RejectProxyRequests(next http.Handler) http.Handler {
+// have HTTP methods not contained in methods. For all other requests, the
+// handler next is called. If forward is not nil, proxy requests are passed to
+// forward instead of being rejected.
+func RejectProxyRequests(next, forward http.Handler, methods []string, shared *Shared) http.Handler {
+	allowed := make(map[string]struct{}, len(methods))
+	for _, method := range methods {
+		allowed[method] = struct{}{}
+	}
+	allow := strings.Join(methods, ", ")
+
 	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
 		// reject proxy requests
-		if req.URL.Host != "" {
-			log.Printf("%v reject proxy request for %v", req.RemoteAddr, req.URL)
-
-			rw.Header().Set("Server", "distriproxy")
-			rw.WriteHeader(http.StatusBadRequest)
-			fmt.Fprintf(rw, "this is not a proxy\n")
+		if req.URL.Host != "" && forward == nil {
+			e := errBadRequest("%v reject proxy request for %v", clientIP(req), req.URL)
+			e.Message = "this is not a proxy\n"
+			shared.writeError(rw, req, "", e)
 			return
 		}
 
-		// only allow GET and HEAD
-		if req.Method != http.MethodGet && req.Method != http.MethodHead {
-			log.Printf("%v reject invalid method", req.RemoteAddr)
+		if _, ok := allowed[req.Method]; !ok {
+			rw.Header().Set("Allow", allow)
+			shared.writeError(rw, req, "", errMethodNotAllowed("%v reject invalid method %v", clientIP(req), req.Method))
+			return
+		}
 
-			rw.Header().Set("Server", "distriproxy")
-			rw.WriteHeader(http.StatusMethodNotAllowed)
+		if req.URL.Host != "" {
+			forward.ServeHTTP(rw, req)
 			return
 		}
 
@@ -39,93 +61,636 @@ func RejectProxyRequests(next http.Handler) http.Handler {
 	})
 }
 
+// copyBufferSize is the size of the buffer used to pass response bodies from
+// the upstream server to the client.
+const copyBufferSize = 64 << 10
+
+// readerOnly hides all methods except Read, so io.CopyBuffer does not call
+// WriteTo and uses the buffer.
+type readerOnly struct {
+	io.Reader
+}
+
+// flushWriter flushes the ResponseWriter after each write, it is used for
+// streaming responses of unknown length.
+type flushWriter struct {
+	rw http.ResponseWriter
+	f  http.Flusher
+}
+
+// newFlushWriter returns a writer which flushes rw after each write, if rw
+// supports it.
+func newFlushWriter(rw http.ResponseWriter) io.Writer {
+	f, ok := rw.(http.Flusher)
+	if !ok {
+		return writerOnly{rw}
+	}
+	return flushWriter{rw: rw, f: f}
+}
+
+func (w flushWriter) Write(p []byte) (int, error) {
+	n, err := w.rw.Write(p)
+	if n > 0 {
+		w.f.Flush()
+	}
+	return n, err
+}
+
 // Proxy forwards requests repositories to an upstream server.
 type Proxy struct {
 	Name   string
 	Source string
 	Client *http.Client
+
+	// Root is set for upstreams with a file:// URL, files are then served
+	// from the local file system and Client is not used.
+	Root http.FileSystem
+
+	// VerifyByHash enables checking the digest of files requested via apt's
+	// by-hash paths before they are passed on to the client.
+	VerifyByHash bool
+
+	// Keyring is used to verify the signature of InRelease and Release
+	// files if set, files with an invalid signature are answered with 502.
+	Keyring openpgp.EntityList
+
+	// rewrites are applied to the request path
+	rewrites []rewriteRule
+
+	// stripPrefix is removed from the request path and addPrefix is added,
+	// after the rewrites have been applied
+	stripPrefix string
+	addPrefix   string
+
+	// quiet disables logging of successful requests for this path
+	quiet bool
+
+	// responseHeaders modifies the response header for this path, after
+	// the global rules in Shared.ResponseHeaders
+	responseHeaders *ResponseHeaders
+
+	// host is the host name of the upstream server
+	host string
+
+	// forwardQuery passes the query string of the request on to the
+	// upstream server
+	forwardQuery bool
+
+	// parallel bounds the number of concurrent requests to the upstream
+	// server of this path, it may be nil
+	parallel *UpstreamLimiter
+
+	// authorization is sent in the Authorization header to the upstream
+	// server, replacing the header from the client
+	authorization string
+
+	// stats is updated for each request if the status endpoint is enabled
+	stats *pathStats
+
+	*Shared
+}
+
+// Shared collects the state which is shared between the proxies for all
+// paths.
+type Shared struct {
+	// ErrorPages renders the bodies of error responses.
+	ErrorPages *ErrorPages
+
+	// Limiter bounds the number of concurrent upstream requests.
+	Limiter *UpstreamLimiter
+
+	// QueueTimeout is the time requests wait for a free upstream connection
+	// when a limit is reached.
+	QueueTimeout time.Duration
+
+	// UserAgent is sent to the upstream servers instead of the client's
+	// User-Agent header. If it is empty, no User-Agent is sent.
+	UserAgent string
+
+	// LogLevel controls which messages are logged.
+	LogLevel LogLevel
+
+	// LogSampleRate is the fraction (between 0 and 1) of successful
+	// requests which are logged, errors are always logged. Zero logs all
+	// requests, like 1.
+	LogSampleRate float64
+
+	// Status collects statistics for the status endpoint, it may be nil.
+	Status *Status
+
+	// ResponseHeaders modifies the header of all responses, it may be nil.
+	ResponseHeaders *ResponseHeaders
+
+	// NegativeCache remembers 404 and 410 responses from upstream servers,
+	// it may be nil.
+	NegativeCache *NegativeCache
+
+	// BufferThreshold is the maximum size of upstream responses without a
+	// Content-Length which are read completely before being sent to the
+	// client, larger responses are streamed. Zero disables buffering.
+	BufferThreshold int64
+
+	// SlowRequestThreshold is the time to the response header from the
+	// upstream server above which a warning is logged, zero disables it.
+	SlowRequestThreshold time.Duration
+
+	// ViaPseudonym identifies distriproxy in the Via header of requests and
+	// responses, the header is not sent if it is empty.
+	ViaPseudonym string
+
+	// NodeID is added to the hops header of upstream requests if set, for
+	// detecting loops between several instances.
+	NodeID string
+
+	// FilterRequestHeaders contains the canonical names of request header
+	// fields which are not sent to the upstream server.
+	FilterRequestHeaders map[string]struct{}
+
+	// FilterResponseHeaders contains the canonical names of header fields
+	// of upstream responses which are not passed on to the client. If
+	// AllowResponseHeaders is not nil, only the fields it contains are
+	// passed on (and those needed for transferring the body).
+	FilterResponseHeaders map[string]struct{}
+	AllowResponseHeaders  map[string]struct{}
+
+	// MaxResponseHeaders limits the number of header fields accepted from
+	// the upstream server, zero means no limit.
+	MaxResponseHeaders int
+
+	// MaintenanceRetryAfter is sent in the Retry-After header of requests
+	// answered in maintenance mode, zero means five minutes.
+	MaintenanceRetryAfter time.Duration
+
+	// maintenance is non-zero while upstream servers must not be contacted,
+	// it is accessed atomically.
+	maintenance int32
 }
 
-// NewProxy initializes a new proxy repositories using upstream as
-// the source url for packages and files. If no http.Client is provided,
-// http.DefaultClient is used.
-func NewProxy(prefix, upstream string, client *http.Client) http.Handler {
+// NewProxy initializes a new proxy repositories for the path using the
+// configured URL as the source url for packages and files. If no http.Client
+// is provided, http.DefaultClient is used. For a file:// URL as the upstream,
+// files are served from the local directory instead.
+func NewProxy(cfg Path, client *http.Client, shared *Shared) (http.Handler, error) {
 	// use the default client if none is provided
 	if client == nil {
 		client = http.DefaultClient
 	}
 
 	// strip trailing slash, it is added back in the handler below
-	upstream = strings.TrimRight(upstream, "/")
+	upstream := strings.TrimRight(cfg.URL, "/")
 
 	p := &Proxy{
-		Name:   prefix,
+		Name:   cfg.Path,
 		Source: upstream,
 		Client: client,
+
+		responseHeaders: cfg.ResponseHeaders,
+		quiet:           cfg.Log != nil && !*cfg.Log,
+
+		Shared: shared,
+	}
+
+	if u, err := url.Parse(upstream); err == nil {
+		p.host = u.Host
+	}
+
+	if cfg.VerifyByHash != nil {
+		p.VerifyByHash = *cfg.VerifyByHash
+	}
+
+	if cfg.ForwardQuery != nil {
+		p.forwardQuery = *cfg.ForwardQuery
+	}
+
+	if cfg.MaxParallel != nil && *cfg.MaxParallel > 0 {
+		p.parallel = NewUpstreamLimiter(*cfg.MaxParallel, 0, shared.QueueTimeout)
+	}
+
+	if cfg.UpstreamAuth != nil {
+		authorization, err := upstreamAuthorization(*cfg.UpstreamAuth)
+		if err != nil {
+			return nil, fmt.Errorf("path %v: %v", cfg.Path, err)
+		}
+		p.authorization = authorization
+	}
+
+	if cfg.GPGKeyring != nil {
+		keyring, err := loadKeyring(*cfg.GPGKeyring)
+		if err != nil {
+			return nil, fmt.Errorf("path %v: %v", cfg.Path, err)
+		}
+		p.Keyring = keyring
+	}
+
+	if shared.Status != nil {
+		p.stats = shared.Status.register(cfg.Path, upstream)
+	}
+
+	rewrites, err := compileRewrites(cfg.Rewrites)
+	if err != nil {
+		return nil, fmt.Errorf("path %v: %v", cfg.Path, err)
+	}
+	p.rewrites = rewrites
+
+	p.stripPrefix = normalizePrefix(stringValue(cfg.StripPrefix))
+	p.addPrefix = normalizePrefix(stringValue(cfg.AddPrefix))
+
+	if strings.HasPrefix(upstream, "file://") {
+		p.Root = http.Dir(strings.TrimPrefix(upstream, "file://"))
+	}
+
+	return http.StripPrefix(pathPrefix(cfg.Path), p), nil
+}
+
+// pathPrefix returns the prefix of the request paths handled by a path
+// block, without a trailing slash. For the path "/", which handles all
+// requests not matched by another path, this is the empty string.
+func pathPrefix(p string) string {
+	return strings.TrimRight(p, "/")
+}
+
+func (p *Proxy) log(level LogLevel, req *http.Request, msg string, args ...interface{}) {
+	if level > p.LogLevel {
+		return
+	}
+
+	log.Printf(p.logPrefix(req)+msg, args...)
+}
+
+// logResult logs the final message for a request with the status sent to
+// the client. Unless the status is an error, the message (and the access log
+// line) is left out for paths with logging disabled, and only a sample of the
+// requests is logged if a sample rate is configured.
+func (p *Proxy) logResult(req *http.Request, status int, msg string, args ...interface{}) {
+	if status < 400 {
+		if p.quiet || !logSampled(p.LogSampleRate, rand.Float64) {
+			skipAccessLog(req)
+			return
+		}
+	}
+
+	p.log(LogInfo, req, msg, args...)
+}
+
+// logSampled reports whether a successful request is logged with the sample
+// rate, random returns a number in [0, 1). A rate of zero (unset) or one
+// logs all requests.
+func logSampled(rate float64, random func() float64) bool {
+	if rate <= 0 || rate >= 1 {
+		return true
+	}
+
+	return random() < rate
+}
+
+func (p *Proxy) logPrefix(req *http.Request) string {
+	return fmt.Sprintf("%v %v %v %v ", p.Name, clientIP(req), req.Method, req.URL.Path)
+}
+
+// fail logs the error and sends the error response to the client.
+func (p *Proxy) fail(rw http.ResponseWriter, req *http.Request, e *proxyError) {
+	p.writeError(rw, req, p.logPrefix(req), e)
+}
+
+// applyResponseHeaders applies the global and the per-path rules for the
+// response header.
+func (p *Proxy) applyResponseHeaders(header http.Header) {
+	applyResponseHeaders(header, p.Shared.ResponseHeaders)
+	applyResponseHeaders(header, p.responseHeaders)
+}
+
+// serveFile answers the request for filename from the local directory
+// p.Root. Range requests and conditional requests are handled by
+// http.ServeContent, path traversal outside of the directory is prevented by
+// http.Dir.
+func (p *Proxy) serveFile(rw http.ResponseWriter, req *http.Request, filename string) {
+	f, err := p.Root.Open(filename)
+	if os.IsNotExist(err) {
+		p.fail(rw, req, errNotFound("---> file not found"))
+		return
+	}
+
+	if err != nil {
+		p.fail(rw, req, errInternal("opening file failed: %v", err))
+		return
+	}
+
+	defer func() {
+		_ = f.Close()
+	}()
+
+	fi, err := f.Stat()
+	if err != nil {
+		p.fail(rw, req, errInternal("stat file failed: %v", err))
+		return
+	}
+
+	// do not list directories
+	if fi.IsDir() {
+		p.fail(rw, req, errNotFound("---> is a directory"))
+		return
 	}
 
-	return http.StripPrefix(prefix, p)
+	p.addVia(rw.Header(), req.ProtoMajor, req.ProtoMinor)
+	setServer(rw.Header())
+	p.applyResponseHeaders(rw.Header())
+
+	// http.ServeContent decides about the status (e.g. for range requests),
+	// record it for the log
+	rec, wrapped := newResponseRecorder(rw)
+	http.ServeContent(wrapped, req, fi.Name(), fi.ModTime(), f)
+
+	p.logResult(req, rec.Status(), "---> %d %v from file, %d bytes", rec.Status(), http.StatusText(rec.Status()), rec.Bytes())
 }
 
-func (p *Proxy) log(req *http.Request, msg string, args ...interface{}) {
-	prefix := fmt.Sprintf("%v %v %v %v ", p.Name, req.RemoteAddr, req.Method, req.URL.Path)
-	log.Printf(prefix+msg, args...)
+// cleanPath collapses repeated slashes and resolves dot segments in the
+// request path p, so that paths like `/pool//main/./x.deb` are not passed on
+// to the upstream server. A trailing slash is preserved.
+func cleanPath(p string) string {
+	cleaned := path.Clean("/" + p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
 }
 
-// filterHeadersToUpstream contains request header names that are not sent to
-// the upstream server.
-var filterHeadersToUpstream = map[string]struct{}{
-	"Connection": struct{}{},
-	"Host":       struct{}{},
+// containsDotDot reports whether the (already unescaped) request path p
+// contains a ".." segment.
+func containsDotDot(p string) bool {
+	segments := strings.FieldsFunc(p, func(r rune) bool {
+		return r == '/' || r == '\\'
+	})
+
+	for _, segment := range segments {
+		if segment == ".." {
+			return true
+		}
+	}
+
+	return false
 }
 
 func (p *Proxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
-	upstreamURL := p.Source + req.URL.Path
+	if p.stats == nil {
+		p.serveHTTP(rw, req)
+		return
+	}
+
+	atomic.AddInt64(&p.stats.requests, 1)
+	atomic.AddInt64(&p.stats.inFlight, 1)
+	defer atomic.AddInt64(&p.stats.inFlight, -1)
+
+	rec, wrapped := newResponseRecorder(rw)
+	p.serveHTTP(wrapped, req)
+
+	atomic.AddInt64(&p.stats.bytes, rec.Bytes())
+	if rec.Status() >= 500 {
+		atomic.AddInt64(&p.stats.errors, 1)
+	}
+}
+
+func (p *Proxy) serveHTTP(rw http.ResponseWriter, req *http.Request) {
+	// reject path traversal, also when encoded as %2e%2e
+	if containsDotDot(req.URL.Path) {
+		p.fail(rw, req, errBadRequest("reject path with dot-dot segment"))
+		return
+	}
+
+	reqPath := cleanPath(req.URL.Path)
+	if len(p.rewrites) > 0 {
+		reqPath = cleanPath(applyRewrites(p.rewrites, reqPath))
+	}
+	reqPath = replacePrefix(reqPath, p.stripPrefix, p.addPrefix)
+
+	if p.Root != nil {
+		p.serveFile(rw, req, reqPath)
+		return
+	}
+
+	if p.inMaintenance() {
+		rw.Header().Set("Retry-After", p.retryAfterMaintenance())
+		p.fail(rw, req, errUnavailable("maintenance mode, not contacting upstream"))
+		return
+	}
+
+	// escape the path again so that characters like '?' or '%' in the
+	// decoded path do not change the meaning of the upstream URL, an
+	// unmodified path is passed on as the client has escaped it
+	escapedPath := (&url.URL{Path: reqPath}).EscapedPath()
+	if reqPath == req.URL.Path {
+		escapedPath = req.URL.EscapedPath()
+	}
+	upstreamURL := p.Source + escapedPath
 	upstreamReq, err := http.NewRequest(req.Method, upstreamURL, nil)
 	if err != nil {
-		p.log(req, "constructing upstream request failed: %v", err)
-		rw.WriteHeader(http.StatusInternalServerError)
+		p.fail(rw, req, errInternal("constructing upstream request failed: %v", err))
 		return
 	}
 
+	if p.forwardQuery {
+		upstreamReq.URL.RawQuery = req.URL.RawQuery
+	}
+
 	// copy some headers from incoming request to upstream request
-	for name, values := range req.Header {
-		if _, ok := filterHeadersToUpstream[name]; ok {
-			continue
-		}
-		upstreamReq.Header[name] = values
+	copyRequestHeader(upstreamReq.Header, req.Header, p.FilterRequestHeaders)
+	upstreamReq.Header.Del("Host")
+
+	// an empty value stops the http client from sending its default
+	upstreamReq.Header.Set("User-Agent", p.UserAgent)
+
+	if p.authorization != "" {
+		upstreamReq.Header.Set("Authorization", p.authorization)
+	}
+
+	p.addVia(upstreamReq.Header, req.ProtoMajor, req.ProtoMinor)
+
+	if p.NodeID != "" {
+		hops := append(append([]string{}, req.Header[hopsHeader]...), p.NodeID)
+		upstreamReq.Header.Set(hopsHeader, strings.Join(hops, ", "))
+	}
+
+	h, digest, verify := parseByHash(reqPath)
+	verify = verify && p.VerifyByHash && req.Method == http.MethodGet
+	if verify {
+		// the digest is computed over the uncompressed file, request it
+		// without content encoding
+		upstreamReq.Header.Del("Accept-Encoding")
+	}
+
+	verifySignature := p.Keyring != nil && isSignedMetadata(reqPath) && req.Method == http.MethodGet
+	if verifySignature {
+		// the signature covers the whole uncompressed file
+		upstreamReq.Header.Del("Accept-Encoding")
+		upstreamReq.Header.Del("Range")
+		upstreamReq.Header.Del("If-Range")
+	}
+
+	if status, ok := p.NegativeCache.Get(upstreamReq.URL.String()); ok {
+		e := errNotFound("---> %d %v (negative cache)", status, http.StatusText(status))
+		e.Status = status
+		p.fail(rw, req, e)
+		return
+	}
+
+	// wait for the limit of the path first, so that queued requests do not
+	// hold a slot of the global limits
+	releasePath, err := p.parallel.Acquire(req.Context(), p.host)
+	if err != nil {
+		p.fail(rw, req, errUnavailable("%v", err))
+		return
+	}
+	defer releasePath()
+
+	release, err := p.Limiter.Acquire(req.Context(), p.host)
+	if err != nil {
+		p.fail(rw, req, errUnavailable("%v", err))
+		return
 	}
+	defer release()
 
+	p.log(LogDebug, req, "upstream request %v%v", upstreamReq.URL, formatHeader(upstreamReq.Header))
+
+	start := time.Now()
 	res, err := ctxhttp.Do(req.Context(), p.Client, upstreamReq)
+	firstByte := time.Since(start)
+	if err != nil && req.Context().Err() == context.DeadlineExceeded {
+		p.fail(rw, req, errGatewayTimeout("upstream request aborted after %v, max_request_duration exceeded", firstByte))
+		return
+	}
 	if err != nil {
-		p.log(req, "upstream request failed: %v", err)
-		rw.WriteHeader(http.StatusBadGateway)
+		p.fail(rw, req, errBadGateway("upstream request failed: %v", err))
 		return
 	}
 
-	// copy header from response
-	for name, values := range res.Header {
-		rw.Header()[name] = values
+	p.log(LogDebug, req, "upstream response %v%v", res.Status, formatHeader(res.Header))
+
+	if p.SlowRequestThreshold > 0 && firstByte > p.SlowRequestThreshold {
+		p.log(LogWarn, req, "slow upstream request: %v responded after %v", upstreamReq.URL, firstByte)
 	}
 
-	rw.Header().Add("Via", "distriproxy")
+	if n := countHeaders(res.Header); p.MaxResponseHeaders > 0 && n > p.MaxResponseHeaders {
+		_ = res.Body.Close()
+		p.fail(rw, req, errBadGateway("upstream response has %d header fields", n))
+		return
+	}
+
+	if res.StatusCode == http.StatusNotFound || res.StatusCode == http.StatusGone {
+		p.NegativeCache.Add(upstreamReq.URL.String(), res.StatusCode)
+	}
+
+	// the upstream server may use gzip even if it was not requested, the
+	// client must receive an encoding it accepts
+	if req.Method == http.MethodGet && res.StatusCode == http.StatusOK {
+		decoded, err := decodeUnacceptable(upstreamReq.Header, res)
+		if err != nil {
+			_ = res.Body.Close()
+			p.fail(rw, req, errBadGateway("decompressing upstream response failed: %v", err))
+			return
+		}
+
+		if decoded {
+			p.log(LogDebug, req, "decompressing response, gzip was not requested")
+		}
+	}
+
+	var body io.Reader = res.Body
+	if verify && res.StatusCode == http.StatusOK {
+		f, n, err := readVerified(res.Body, h, digest)
+		_ = res.Body.Close()
+		if err != nil {
+			p.fail(rw, req, errBadGateway("verifying by-hash file failed: %v", err))
+			return
+		}
+		defer func() {
+			_ = f.Close()
+		}()
+
+		body = f
+		res.Header.Set("Content-Length", strconv.FormatInt(n, 10))
+	}
+
+	if verifySignature && res.StatusCode == http.StatusOK {
+		buf, err := readLimited(res.Body)
+		_ = res.Body.Close()
+		if err != nil {
+			p.fail(rw, req, errBadGateway("reading signed file failed: %v", err))
+			return
+		}
+
+		signer, err := p.verifySignature(req.Context(), upstreamURL, buf)
+		if err != nil {
+			p.fail(rw, req, errBadGateway("verifying signature failed: %v", err))
+			return
+		}
+
+		p.log(LogDebug, req, "valid signature by key %016X", signer.PrimaryKey.KeyId)
+
+		body = bytes.NewReader(buf)
+		res.Header.Set("Content-Length", strconv.Itoa(len(buf)))
+	}
+
+	// buffer small responses of unknown length, so that the client receives
+	// a Content-Length instead of a chunked response
+	if p.BufferThreshold > 0 && res.Header.Get("Content-Length") == "" && req.Method != http.MethodHead {
+		buf, err := ioutil.ReadAll(io.LimitReader(body, p.BufferThreshold+1))
+		if err != nil {
+			_ = res.Body.Close()
+			p.fail(rw, req, errBadGateway("reading upstream response failed: %v", err))
+			return
+		}
+
+		if int64(len(buf)) <= p.BufferThreshold {
+			body = bytes.NewReader(buf)
+			res.Header.Set("Content-Length", strconv.Itoa(len(buf)))
+		} else {
+			// too large, pass on the data read so far and stream the rest
+			body = io.MultiReader(bytes.NewReader(buf), body)
+		}
+	}
+
+	// copy header from response
+	copyResponseHeader(rw.Header(), res.Header, p.AllowResponseHeaders, p.FilterResponseHeaders)
+
+	// existing Via fields from the upstream server are kept, ours is added
+	// at the end
+	p.addVia(rw.Header(), res.ProtoMajor, res.ProtoMinor)
+	setServer(rw.Header())
+	p.applyResponseHeaders(rw.Header())
 
 	// send status
 	rw.WriteHeader(res.StatusCode)
 
-	// copy body to client
-	_, err = io.Copy(rw, res.Body)
+	// copy body to client, responses of unknown length are flushed after
+	// each write so that the client sees the data as soon as it arrives,
+	// for all others the 64KiB writes are passed on without buffering;
+	// neither ReadFrom nor WriteTo are used, they would bypass the buffer
+	var wr io.Writer = writerOnly{rw}
+	if rw.Header().Get("Content-Length") == "" {
+		wr = newFlushWriter(rw)
+	}
+	n, err := io.CopyBuffer(wr, readerOnly{body}, make([]byte, copyBufferSize))
+	total := time.Since(start)
 	if err != nil {
-		p.log(req, "passing response failed: %v", err)
+		if req.Context().Err() == context.DeadlineExceeded {
+			p.log(LogWarn, req, "aborted after %d bytes, max_request_duration exceeded", n)
+		} else {
+			p.log(LogWarn, req, "passing response failed after %d bytes, %v: %v", n, total, err)
+		}
 		_ = res.Body.Close()
 		return
 	}
 
 	err = res.Body.Close()
 	if err != nil {
-		p.log(req, "closing upstream response body failed: %v", err)
+		p.log(LogWarn, req, "closing upstream response body failed: %v", err)
+		return
+	}
+
+	stats := fmt.Sprintf("%d bytes, first byte %v, total %v", n, firstByte, total)
+	if res.StatusCode == http.StatusNotFound || res.StatusCode == http.StatusGone {
+		p.logResult(req, res.StatusCode, "---> %v (not found upstream), %v", res.Status, stats)
 		return
 	}
 
-	p.log(req, "---> %v", res.Status)
+	p.logResult(req, res.StatusCode, "---> %v, %v", res.Status, stats)
 }
@@ -0,0 +1,696 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestProxy returns a server which proxies requests below cfg.Path.
+func newTestProxy(t *testing.T, cfg Path) *httptest.Server {
+	t.Helper()
+
+	return newTestProxyShared(t, cfg, &Shared{LogLevel: LogError})
+}
+
+// newTestProxyShared returns a server which proxies requests below cfg.Path
+// with the shared settings.
+func newTestProxyShared(t *testing.T, cfg Path, shared *Shared) *httptest.Server {
+	t.Helper()
+
+	proxy, err := NewProxy(cfg, nil, shared)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(pathPrefix(cfg.Path)+"/", proxy)
+
+	return httptest.NewServer(mux)
+}
+
+// get requests url and returns the response and the body.
+func get(t *testing.T, url string) (*http.Response, string) {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return do(t, http.DefaultClient, req)
+}
+
+// do sends req with client and returns the response and the body.
+func do(t *testing.T, client *http.Client, req *http.Request) (*http.Response, string) {
+	t.Helper()
+
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return res, string(buf)
+}
+
+func TestCleanPath(t *testing.T) {
+	var tests = []struct {
+		path string
+		want string
+	}{
+		{"", "/"},
+		{"/", "/"},
+		{"//", "/"},
+		{"/pool/main/x.deb", "/pool/main/x.deb"},
+		{"pool/main/x.deb", "/pool/main/x.deb"},
+		{"/pool//main/./x.deb", "/pool/main/x.deb"},
+		{"/dists/buster/", "/dists/buster/"},
+		{"/dists//buster//", "/dists/buster/"},
+		{"/dists/buster/.", "/dists/buster"},
+		{"/pool/../dists/x", "/dists/x"},
+		{"/../../etc/passwd", "/etc/passwd"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			got := cleanPath(test.path)
+			if got != test.want {
+				t.Fatalf("wrong path returned, want %q, got %q", test.want, got)
+			}
+		})
+	}
+}
+
+func TestContainsDotDot(t *testing.T) {
+	var tests = []struct {
+		path   string
+		dotdot bool
+	}{
+		{"/pool/main/x.deb", false},
+		{"/", false},
+		{"", false},
+		{"/pool/x..deb", false},
+		{"/pool/..x/y", false},
+		{"/pool/.../y", false},
+		{"/pool/./y", false},
+		{"/..", true},
+		{"..", true},
+		{"/pool/../etc/passwd", true},
+		{"/pool/..", true},
+		{"/pool//..//x", true},
+		{`/pool\..\x`, true},
+		{`..\x`, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			if containsDotDot(test.path) != test.dotdot {
+				t.Fatalf("wrong result for %q, want %v", test.path, test.dotdot)
+			}
+		})
+	}
+}
+
+// readLine reads a line from rd, it fails the test after a timeout.
+func readLine(t *testing.T, rd *bufio.Reader) string {
+	t.Helper()
+
+	type result struct {
+		line string
+		err  error
+	}
+
+	ch := make(chan result, 1)
+	go func() {
+		line, err := rd.ReadString('\n')
+		ch <- result{line, err}
+	}()
+
+	select {
+	case r := <-ch:
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		return r.line
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout reading from the response body")
+	}
+
+	return ""
+}
+
+func TestProxyStreaming(t *testing.T) {
+	next := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		// no Content-Length, the response is sent chunked
+		fmt.Fprintf(rw, "first\n")
+		rw.(http.Flusher).Flush()
+
+		select {
+		case <-next:
+		case <-time.After(5 * time.Second):
+		}
+
+		fmt.Fprintf(rw, "second\n")
+	}))
+	defer upstream.Close()
+
+	srv := newTestProxy(t, Path{Path: "/debian", URL: upstream.URL})
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL + "/debian/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+
+	if res.ContentLength != -1 {
+		t.Fatalf("unexpected Content-Length %v", res.ContentLength)
+	}
+
+	// the first line must arrive while the upstream server is still waiting
+	rd := bufio.NewReader(res.Body)
+	if line := readLine(t, rd); line != "first\n" {
+		t.Fatalf("wrong first line %q", line)
+	}
+
+	close(next)
+
+	if line := readLine(t, rd); line != "second\n" {
+		t.Fatalf("wrong second line %q", line)
+	}
+}
+
+// echoHeader returns a server which answers with the request header it has
+// received, encoded as JSON.
+func echoHeader() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(rw).Encode(req.Header)
+	}))
+}
+
+// getHeaders sends req through client to a server created by echoHeader and
+// returns the header the server has received.
+func getHeaders(t *testing.T, client *http.Client, req *http.Request) http.Header {
+	t.Helper()
+
+	res, body := do(t, client, req)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %v: %q", res.Status, body)
+	}
+
+	var header http.Header
+	err := json.Unmarshal([]byte(body), &header)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return header
+}
+
+func TestProxyFilterRequestHeaders(t *testing.T) {
+	upstream := echoHeader()
+	defer upstream.Close()
+
+	var tests = []struct {
+		name    string
+		filter  []string
+		header  http.Header
+		removed []string
+		kept    []string
+	}{
+		{
+			name:   "default",
+			filter: defaultFilterRequestHeaders,
+			header: http.Header{
+				"Keep-Alive":       {"timeout=5"},
+				"Proxy-Connection": {"keep-alive"},
+				"Te":               {"trailers"},
+				"Trailer":          {"X-Checksum"},
+				"Upgrade":          {"h2c"},
+				"Http2-Settings":   {"AAMAAABkAARAAAAAAAIAAAAA"},
+				"Cookie":           {"session=1"},
+				"If-None-Match":    {`"abc"`},
+				"X-Custom":         {"foo"},
+			},
+			removed: []string{"Keep-Alive", "Proxy-Connection", "Te", "Trailer", "Upgrade", "Http2-Settings"},
+			kept:    []string{"Cookie", "If-None-Match", "X-Custom"},
+		},
+		{
+			name:   "configured",
+			filter: []string{"cookie", "X-SECRET"},
+			header: http.Header{
+				"Cookie":        {"session=1"},
+				"X-Secret":      {"hunter2"},
+				"If-None-Match": {`"abc"`},
+				"Range":         {"bytes=0-10"},
+				"Keep-Alive":    {"timeout=5"},
+			},
+			removed: []string{"Cookie", "X-Secret"},
+			kept:    []string{"If-None-Match", "Range", "Keep-Alive"},
+		},
+		{
+			name:   "connection",
+			filter: nil,
+			header: http.Header{
+				"Connection": {"X-Hop, x-other"},
+				"X-Hop":      {"1"},
+				"X-Other":    {"2"},
+				"X-Custom":   {"foo"},
+			},
+			removed: []string{"X-Hop", "X-Other"},
+			kept:    []string{"X-Custom"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			shared := &Shared{
+				LogLevel:             LogError,
+				FilterRequestHeaders: headerSet(test.filter),
+			}
+
+			srv := newTestProxyShared(t, Path{Path: "/debian", URL: upstream.URL}, shared)
+			defer srv.Close()
+
+			req, err := http.NewRequest(http.MethodGet, srv.URL+"/debian/dists/buster/Release", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for name, values := range test.header {
+				req.Header[name] = values
+			}
+
+			header := getHeaders(t, http.DefaultClient, req)
+
+			for _, name := range test.removed {
+				if values, ok := header[name]; ok {
+					t.Errorf("header %v was passed to the upstream server: %q", name, values)
+				}
+			}
+
+			for _, name := range test.kept {
+				if header.Get(name) != test.header.Get(name) {
+					t.Errorf("header %v was not passed to the upstream server, want %q, got %q",
+						name, test.header.Get(name), header.Get(name))
+				}
+			}
+		})
+	}
+}
+
+func TestProxyFilterResponseHeaders(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "text/plain")
+		rw.Header().Set("Content-Length", "6")
+		rw.Header().Set("ETag", `"abc"`)
+		rw.Header().Set("Last-Modified", "Mon, 01 Jul 2019 12:00:00 GMT")
+		rw.Header().Set("Set-Cookie", "session=1")
+		rw.Header().Set("Set-Cookie2", "session=2")
+		rw.Header().Set("X-Internal", "backend-3")
+		fmt.Fprint(rw, "hello\n")
+	}))
+	defer upstream.Close()
+
+	var tests = []struct {
+		name    string
+		deny    []string
+		allow   []string
+		removed []string
+		kept    []string
+	}{
+		{
+			name:    "default",
+			deny:    defaultFilterResponseHeaders,
+			removed: []string{"Set-Cookie", "Set-Cookie2"},
+			kept:    []string{"Content-Type", "Content-Length", "Etag", "Last-Modified", "X-Internal"},
+		},
+		{
+			name:    "configured",
+			deny:    []string{"x-internal", "LAST-MODIFIED"},
+			removed: []string{"X-Internal", "Last-Modified"},
+			kept:    []string{"Content-Type", "Content-Length", "Etag", "Set-Cookie", "Set-Cookie2"},
+		},
+		{
+			name:    "allow",
+			deny:    defaultFilterResponseHeaders,
+			allow:   []string{"content-type", "ETag"},
+			removed: []string{"Last-Modified", "Set-Cookie", "Set-Cookie2", "X-Internal"},
+			kept:    []string{"Content-Type", "Content-Length", "Etag"},
+		},
+		{
+			name:  "allow-denied",
+			deny:  defaultFilterResponseHeaders,
+			allow: []string{"Set-Cookie", "X-Internal"},
+			// Content-Type is not checked, net/http sniffs it when missing
+			removed: []string{"Etag", "Last-Modified", "Set-Cookie", "Set-Cookie2"},
+			kept:    []string{"Content-Length", "X-Internal"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			shared := &Shared{
+				LogLevel:              LogError,
+				FilterResponseHeaders: headerSet(test.deny),
+			}
+			if test.allow != nil {
+				shared.AllowResponseHeaders = headerSet(test.allow)
+			}
+
+			srv := newTestProxyShared(t, Path{Path: "/debian", URL: upstream.URL}, shared)
+			defer srv.Close()
+
+			res, body := get(t, srv.URL+"/debian/dists/buster/Release")
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("unexpected status %v", res.Status)
+			}
+
+			if body != "hello\n" {
+				t.Errorf("wrong body %q", body)
+			}
+
+			for _, name := range test.removed {
+				if values, ok := res.Header[name]; ok {
+					t.Errorf("header %v was passed to the client: %q", name, values)
+				}
+			}
+
+			for _, name := range test.kept {
+				if res.Header.Get(name) == "" {
+					t.Errorf("header %v was not passed to the client", name)
+				}
+			}
+		})
+	}
+}
+
+func TestLogSampled(t *testing.T) {
+	var tests = []struct {
+		rate   float64
+		random float64
+		logged bool
+	}{
+		{0, 0.99, true},
+		{1, 0.99, true},
+		{0.1, 0, true},
+		{0.1, 0.09, true},
+		{0.1, 0.1, false},
+		{0.1, 0.5, false},
+		{0.5, 0.49, true},
+		{0.5, 0.5, false},
+	}
+
+	for _, test := range tests {
+		random := func() float64 { return test.random }
+		if logSampled(test.rate, random) != test.logged {
+			t.Errorf("wrong result for rate %v and random number %v, want %v", test.rate, test.random, test.logged)
+		}
+	}
+}
+
+func TestProxyLogSampleRate(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/missing" {
+			http.NotFound(rw, req)
+			return
+		}
+		fmt.Fprintf(rw, "hello\n")
+	}))
+	defer upstream.Close()
+
+	buf, restore := captureLog()
+	defer restore()
+
+	var tests = []struct {
+		name   string
+		rate   float64
+		path   string
+		logged bool
+	}{
+		{"unset", 0, "/unset", true},
+		{"all", 1, "/all", true},
+		{"sampled", 1e-12, "/sampled", false},
+		{"sampled-error", 1e-12, "/missing", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			shared := &Shared{LogLevel: LogInfo, LogSampleRate: test.rate}
+			srv := newTestProxyShared(t, Path{Path: "/debian", URL: upstream.URL}, shared)
+
+			_, _ = get(t, srv.URL+"/debian"+test.path)
+
+			// wait for the handler to return
+			srv.Close()
+
+			logged := strings.Contains(buf.String(), "GET "+test.path+" --->")
+			if logged != test.logged {
+				t.Fatalf("wrong logging, want %v, got %v:\n%s", test.logged, logged, buf.String())
+			}
+		})
+	}
+}
+
+func TestProxyBufferThreshold(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var size int
+		_, err := fmt.Sscanf(req.URL.Path, "/%d", &size)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if req.URL.Query().Get("length") != "" {
+			rw.Header().Set("Content-Length", fmt.Sprint(size))
+		}
+
+		// flush to force a chunked response without Content-Length
+		rw.(http.Flusher).Flush()
+		_, _ = rw.Write([]byte(strings.Repeat("x", size)))
+	}))
+	defer upstream.Close()
+
+	const threshold = 1024
+	forwardQuery := true
+
+	var tests = []struct {
+		name      string
+		threshold int64
+		path      string
+		length    int64
+		size      int
+	}{
+		{"disabled", 0, "/100", -1, 100},
+		{"below", threshold, "/100", 100, 100},
+		{"empty", threshold, "/0", 0, 0},
+		{"at", threshold, "/1024", 1024, 1024},
+		{"above", threshold, "/1025", -1, 1025},
+		{"large", threshold, "/1000000", -1, 1000000},
+		{"known-length", threshold, "/5000?length=1", 5000, 5000},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			shared := &Shared{LogLevel: LogError, BufferThreshold: test.threshold}
+			cfg := Path{Path: "/debian", URL: upstream.URL, ForwardQuery: &forwardQuery}
+
+			srv := newTestProxyShared(t, cfg, shared)
+			defer srv.Close()
+
+			res, body := get(t, srv.URL+"/debian"+test.path)
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("unexpected status %v: %q", res.Status, body)
+			}
+
+			if res.ContentLength != test.length {
+				t.Errorf("wrong Content-Length, want %d, got %d", test.length, res.ContentLength)
+			}
+
+			chunked := len(res.TransferEncoding) > 0 && res.TransferEncoding[0] == "chunked"
+			if chunked != (test.length < 0) {
+				t.Errorf("wrong Transfer-Encoding %q", res.TransferEncoding)
+			}
+
+			if len(body) != test.size {
+				t.Errorf("wrong body size, want %d, got %d", test.size, len(body))
+			}
+		})
+	}
+}
+
+func TestProxySlowRequestLog(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if strings.HasPrefix(req.URL.Path, "/slow") {
+			time.Sleep(200 * time.Millisecond)
+		}
+		fmt.Fprint(rw, "hello\n")
+	}))
+	defer upstream.Close()
+
+	buf, restore := captureLog()
+	defer restore()
+
+	var tests = []struct {
+		name      string
+		threshold time.Duration
+		path      string
+		logged    bool
+	}{
+		{"slow", 50 * time.Millisecond, "/slow-1", true},
+		{"fast", 50 * time.Millisecond, "/fast", false},
+		{"below-threshold", 10 * time.Second, "/slow-2", false},
+		{"disabled", 0, "/slow-3", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			shared := &Shared{LogLevel: LogWarn, SlowRequestThreshold: test.threshold}
+			srv := newTestProxyShared(t, Path{Path: "/debian", URL: upstream.URL}, shared)
+
+			res, body := get(t, srv.URL+"/debian"+test.path)
+			if res.StatusCode != http.StatusOK || body != "hello\n" {
+				t.Fatalf("unexpected response %v %q", res.Status, body)
+			}
+
+			// wait for the handler to return
+			srv.Close()
+
+			logged := strings.Contains(buf.String(), "slow upstream request: "+upstream.URL+test.path+" responded after ")
+			if logged != test.logged {
+				t.Fatalf("wrong logging, want %v, got %v:\n%s", test.logged, logged, buf.String())
+			}
+		})
+	}
+}
+
+func TestApplyResponseHeaders(t *testing.T) {
+	var tests = []struct {
+		name   string
+		rules  *ResponseHeaders
+		header http.Header
+		want   http.Header
+	}{
+		{"nil", nil,
+			http.Header{"Cache-Control": {"max-age=60"}},
+			http.Header{"Cache-Control": {"max-age=60"}}},
+		{"set", &ResponseHeaders{Set: map[string]string{"x-mirror": "edge-1"}},
+			http.Header{"Cache-Control": {"max-age=60"}},
+			http.Header{"Cache-Control": {"max-age=60"}, "X-Mirror": {"edge-1"}}},
+		{"override", &ResponseHeaders{Set: map[string]string{"Cache-Control": "public, max-age=300"}},
+			http.Header{"Cache-Control": {"max-age=60", "private"}},
+			http.Header{"Cache-Control": {"public, max-age=300"}}},
+		{"remove", &ResponseHeaders{Remove: []string{"x-powered-by", "X-Missing"}},
+			http.Header{"Cache-Control": {"max-age=60"}, "X-Powered-By": {"PHP/7.3"}},
+			http.Header{"Cache-Control": {"max-age=60"}}},
+		{"remove-then-set", &ResponseHeaders{
+			Set:    map[string]string{"Cache-Control": "no-store"},
+			Remove: []string{"Cache-Control"},
+		},
+			http.Header{"Cache-Control": {"max-age=60"}},
+			http.Header{"Cache-Control": {"no-store"}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			applyResponseHeaders(test.header, test.rules)
+
+			if !reflect.DeepEqual(test.header, test.want) {
+				t.Fatalf("wrong header, want %v, got %v", test.want, test.header)
+			}
+		})
+	}
+}
+
+func TestProxyResponseHeaders(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=60")
+		rw.Header().Set("X-Powered-By", "PHP/7.3")
+		rw.Header().Set("X-Mirror", "upstream")
+		fmt.Fprint(rw, "hello\n")
+	}))
+	defer upstream.Close()
+
+	global := &ResponseHeaders{
+		Set: map[string]string{
+			"Cache-Control":          "public, max-age=300",
+			"X-Content-Type-Options": "nosniff",
+		},
+		Remove: []string{"X-Powered-By"},
+	}
+
+	var tests = []struct {
+		name   string
+		global *ResponseHeaders
+		path   *ResponseHeaders
+		want   map[string][]string
+	}{
+		{"none", nil, nil, map[string][]string{
+			"Cache-Control":          {"max-age=60"},
+			"X-Powered-By":           {"PHP/7.3"},
+			"X-Mirror":               {"upstream"},
+			"X-Content-Type-Options": nil,
+		}},
+		{"global", global, nil, map[string][]string{
+			"Cache-Control":          {"public, max-age=300"},
+			"X-Powered-By":           nil,
+			"X-Mirror":               {"upstream"},
+			"X-Content-Type-Options": {"nosniff"},
+		}},
+		{"path", nil, &ResponseHeaders{Set: map[string]string{"X-Mirror": "edge-1"}}, map[string][]string{
+			"Cache-Control": {"max-age=60"},
+			"X-Powered-By":  {"PHP/7.3"},
+			"X-Mirror":      {"edge-1"},
+		}},
+		// the rules for the path are applied after the global rules
+		{"path-after-global", global, &ResponseHeaders{
+			Set:    map[string]string{"Cache-Control": "no-store"},
+			Remove: []string{"X-Content-Type-Options"},
+		}, map[string][]string{
+			"Cache-Control":          {"no-store"},
+			"X-Powered-By":           nil,
+			"X-Mirror":               {"upstream"},
+			"X-Content-Type-Options": nil,
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			shared := &Shared{LogLevel: LogError, ResponseHeaders: test.global}
+			srv := newTestProxyShared(t, Path{Path: "/debian", URL: upstream.URL, ResponseHeaders: test.path}, shared)
+			defer srv.Close()
+
+			res, body := get(t, srv.URL+"/debian/dists/buster/Release")
+			if res.StatusCode != http.StatusOK || body != "hello\n" {
+				t.Fatalf("unexpected response %v %q", res.Status, body)
+			}
+
+			for name, want := range test.want {
+				if !reflect.DeepEqual(res.Header[name], want) {
+					t.Errorf("wrong value for %v, want %q, got %q", name, want, res.Header[name])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+type clientIPKey struct{}
+
+// peerIP returns the IP address of the peer which sent req.
+func peerIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// clientIP returns the IP address of the client which sent req. Behind a
+// trusted proxy this is the address resolved by RealIP, otherwise the address
+// of the peer.
+func clientIP(req *http.Request) string {
+	if ip, ok := req.Context().Value(clientIPKey{}).(string); ok {
+		return ip
+	}
+	return peerIP(req)
+}
+
+// parseCIDRs parses a list of networks in CIDR notation, single IP addresses
+// are also accepted.
+func parseCIDRs(list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", s)
+			}
+
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+
+	return nets, nil
+}
+
+// trusted reports whether the IP address s is contained in one of the
+// networks.
+func trusted(nets []*net.IPNet, s string) bool {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// resolveClientIP returns the address of the client for a request received
+// from a trusted proxy. X-Forwarded-For is searched from the right for the
+// first address which is not a trusted proxy, if the header is not present
+// X-Real-IP is used.
+func resolveClientIP(nets []*net.IPNet, req *http.Request) (string, bool) {
+	var forwarded []string
+	for _, value := range req.Header["X-Forwarded-For"] {
+		for _, addr := range strings.Split(value, ",") {
+			addr = strings.TrimSpace(addr)
+			if addr != "" {
+				forwarded = append(forwarded, addr)
+			}
+		}
+	}
+
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		if net.ParseIP(forwarded[i]) == nil {
+			// garbage in the header, do not trust anything left of it
+			return "", false
+		}
+
+		if i == 0 || !trusted(nets, forwarded[i]) {
+			return forwarded[i], true
+		}
+	}
+
+	if ip := strings.TrimSpace(req.Header.Get("X-Real-IP")); net.ParseIP(ip) != nil {
+		return ip, true
+	}
+
+	return "", false
+}
+
+// RealIP resolves the IP address of the client for requests sent by one of
+// the trusted proxies and stores it in the request context, see clientIP.
+// The X-Forwarded-For and X-Real-IP headers of requests from other peers are
+// ignored.
+func RealIP(next http.Handler, nets []*net.IPNet) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if trusted(nets, peerIP(req)) {
+			if ip, ok := resolveClientIP(nets, req); ok {
+				req = req.WithContext(context.WithValue(req.Context(), clientIPKey{}, ip))
+			}
+		}
+
+		next.ServeHTTP(rw, req)
+	})
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseCIDRs(t *testing.T) {
+	var tests = []struct {
+		list []string
+		ok   bool
+	}{
+		{[]string{"10.0.0.0/8", "192.168.1.1", "fd00::/8", "::1"}, true},
+		{nil, true},
+		{[]string{"10.0.0.0/33"}, false},
+		{[]string{"10.0.0.256"}, false},
+		{[]string{"example.com"}, false},
+		{[]string{"10.0.0.0/8", ""}, false},
+	}
+
+	for _, test := range tests {
+		_, err := parseCIDRs(test.list)
+		if test.ok && err != nil {
+			t.Errorf("%v: unexpected error %v", test.list, err)
+		}
+
+		if !test.ok && err == nil {
+			t.Errorf("%v: expected error not found", test.list)
+		}
+	}
+}
+
+func TestRealIP(t *testing.T) {
+	nets, err := parseCIDRs([]string{"10.0.0.0/8", "192.168.1.1", "fd00::/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		realIP     string
+		want       string
+	}{
+		{"untrusted", "203.0.113.1:1234", nil, "", "203.0.113.1"},
+		{"untrusted-spoofed", "203.0.113.1:1234", []string{"198.51.100.7"}, "198.51.100.8", "203.0.113.1"},
+		{"trusted-no-header", "10.1.2.3:1234", nil, "", "10.1.2.3"},
+		{"trusted", "10.1.2.3:1234", []string{"198.51.100.7"}, "", "198.51.100.7"},
+		{"trusted-single-ip", "192.168.1.1:1234", []string{"198.51.100.7"}, "", "198.51.100.7"},
+		{"untrusted-single-ip", "192.168.1.2:1234", []string{"198.51.100.7"}, "", "192.168.1.2"},
+		{"trusted-ipv6", "[fd00::1]:1234", []string{"2001:db8::1"}, "", "2001:db8::1"},
+		{"untrusted-ipv6", "[2001:db8::2]:1234", []string{"2001:db8::1"}, "", "2001:db8::2"},
+		{"chain", "10.1.2.3:1234", []string{"198.51.100.7, 10.0.0.5, 10.0.0.6"}, "", "198.51.100.7"},
+		{"chain-spoofed", "10.1.2.3:1234", []string{"1.2.3.4, 198.51.100.7, 10.0.0.5"}, "", "198.51.100.7"},
+		{"chain-several-headers", "10.1.2.3:1234", []string{"1.2.3.4", "198.51.100.7", "10.0.0.5"}, "", "198.51.100.7"},
+		{"chain-all-trusted", "10.1.2.3:1234", []string{"10.0.0.4, 10.0.0.5"}, "", "10.0.0.4"},
+		{"chain-spaces", "10.1.2.3:1234", []string{" 198.51.100.7 ,, 10.0.0.5 "}, "", "198.51.100.7"},
+		{"malformed", "10.1.2.3:1234", []string{"unknown"}, "", "10.1.2.3"},
+		{"malformed-port", "10.1.2.3:1234", []string{"198.51.100.7:4321"}, "", "10.1.2.3"},
+		{"malformed-in-chain", "10.1.2.3:1234", []string{"198.51.100.7, garbage, 10.0.0.5"}, "", "10.1.2.3"},
+		{"malformed-left", "10.1.2.3:1234", []string{"garbage, 198.51.100.7, 10.0.0.5"}, "", "198.51.100.7"},
+		{"real-ip", "10.1.2.3:1234", nil, "198.51.100.8", "198.51.100.8"},
+		{"real-ip-malformed", "10.1.2.3:1234", nil, "garbage", "10.1.2.3"},
+		{"forwarded-before-real-ip", "10.1.2.3:1234", []string{"198.51.100.7"}, "198.51.100.8", "198.51.100.7"},
+		{"no-port", "10.1.2.3", []string{"198.51.100.7"}, "", "198.51.100.7"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got string
+			handler := RealIP(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				got = clientIP(req)
+			}), nets)
+
+			req := httptest.NewRequest(http.MethodGet, "/debian/x.deb", nil)
+			req.RemoteAddr = test.remoteAddr
+			for _, value := range test.forwarded {
+				req.Header.Add("X-Forwarded-For", value)
+			}
+			if test.realIP != "" {
+				req.Header.Set("X-Real-IP", test.realIP)
+			}
+
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			if got != test.want {
+				t.Fatalf("wrong client IP, want %v, got %v", test.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+)
+
+// responseRecorder wraps an http.ResponseWriter and records the status code
+// and the number of body bytes sent to the client.
+type responseRecorder struct {
+	http.ResponseWriter
+
+	status int
+	bytes  int64
+}
+
+// newResponseRecorder returns a recorder for rw and the ResponseWriter to pass
+// to the next handler. It implements http.Flusher, io.ReaderFrom and
+// http.Hijacker only if rw does, so that handlers checking for these
+// interfaces see the same capabilities as without the recorder.
+func newResponseRecorder(rw http.ResponseWriter) (*responseRecorder, http.ResponseWriter) {
+	rec := &responseRecorder{ResponseWriter: rw}
+
+	_, isFlusher := rw.(http.Flusher)
+	_, isReaderFrom := rw.(io.ReaderFrom)
+	_, isHijacker := rw.(http.Hijacker)
+
+	f, rf, h := recordFlusher{rec}, recordReaderFrom{rec}, recordHijacker{rec}
+
+	switch {
+	case isFlusher && isReaderFrom && isHijacker:
+		return rec, struct {
+			*responseRecorder
+			recordFlusher
+			recordReaderFrom
+			recordHijacker
+		}{rec, f, rf, h}
+	case isFlusher && isReaderFrom:
+		return rec, struct {
+			*responseRecorder
+			recordFlusher
+			recordReaderFrom
+		}{rec, f, rf}
+	case isFlusher && isHijacker:
+		return rec, struct {
+			*responseRecorder
+			recordFlusher
+			recordHijacker
+		}{rec, f, h}
+	case isReaderFrom && isHijacker:
+		return rec, struct {
+			*responseRecorder
+			recordReaderFrom
+			recordHijacker
+		}{rec, rf, h}
+	case isFlusher:
+		return rec, struct {
+			*responseRecorder
+			recordFlusher
+		}{rec, f}
+	case isReaderFrom:
+		return rec, struct {
+			*responseRecorder
+			recordReaderFrom
+		}{rec, rf}
+	case isHijacker:
+		return rec, struct {
+			*responseRecorder
+			recordHijacker
+		}{rec, h}
+	}
+
+	return rec, rec
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+
+	n, err := r.ResponseWriter.Write(p)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// writerOnly hides all methods except Write, so io.Copy does not call
+// ReadFrom recursively.
+type writerOnly struct {
+	io.Writer
+}
+
+// recordReaderFrom adds io.ReaderFrom to a recorder.
+type recordReaderFrom struct {
+	rec *responseRecorder
+}
+
+// ReadFrom allows io.Copy to use the optimized implementation of the
+// underlying ResponseWriter (e.g. sendfile).
+func (r recordReaderFrom) ReadFrom(src io.Reader) (int64, error) {
+	if r.rec.status == 0 {
+		r.rec.status = http.StatusOK
+	}
+
+	n, err := r.rec.ResponseWriter.(io.ReaderFrom).ReadFrom(src)
+	r.rec.bytes += n
+	return n, err
+}
+
+// recordFlusher adds http.Flusher to a recorder.
+type recordFlusher struct {
+	rec *responseRecorder
+}
+
+// Flush sends buffered data to the client.
+func (r recordFlusher) Flush() {
+	if r.rec.status == 0 {
+		r.rec.status = http.StatusOK
+	}
+
+	r.rec.ResponseWriter.(http.Flusher).Flush()
+}
+
+// recordHijacker adds http.Hijacker to a recorder.
+type recordHijacker struct {
+	rec *responseRecorder
+}
+
+// Hijack lets the caller take over the connection.
+func (r recordHijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return r.rec.ResponseWriter.(http.Hijacker).Hijack()
+}
+
+// Status returns the status code sent to the client.
+func (r *responseRecorder) Status() int {
+	if r.status == 0 {
+		return http.StatusOK
+	}
+	return r.status
+}
+
+// Bytes returns the number of body bytes sent to the client.
+func (r *responseRecorder) Bytes() int64 {
+	return r.bytes
+}
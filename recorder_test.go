@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// basicWriter is a ResponseWriter without any optional interfaces.
+type basicWriter struct {
+	header http.Header
+	status int
+	buf    bytes.Buffer
+}
+
+func (w *basicWriter) Header() http.Header {
+	if w.header == nil {
+		w.header = make(http.Header)
+	}
+	return w.header
+}
+
+func (w *basicWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.buf.Write(p)
+}
+
+func (w *basicWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+type testFlusher struct{ *basicWriter }
+
+func (w testFlusher) Flush() {}
+
+type testReaderFrom struct{ *basicWriter }
+
+func (w testReaderFrom) ReadFrom(src io.Reader) (int64, error) {
+	return w.buf.ReadFrom(src)
+}
+
+type testHijacker struct{ *basicWriter }
+
+func (w testHijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return nil, nil, nil
+}
+
+type testAllInterfaces struct {
+	*basicWriter
+	testFlusher
+	testReaderFrom
+	testHijacker
+}
+
+func TestResponseRecorderInterfaces(t *testing.T) {
+	var tests = []struct {
+		name       string
+		rw         http.ResponseWriter
+		flusher    bool
+		readerFrom bool
+		hijacker   bool
+	}{
+		{"basic", &basicWriter{}, false, false, false},
+		{"flusher", testFlusher{&basicWriter{}}, true, false, false},
+		{"reader-from", testReaderFrom{&basicWriter{}}, false, true, false},
+		{"hijacker", testHijacker{&basicWriter{}}, false, false, true},
+		{"flusher-reader-from", struct {
+			testFlusher
+			testReaderFrom
+			http.ResponseWriter
+		}{testFlusher{}, testReaderFrom{}, &basicWriter{}}, true, true, false},
+		{"flusher-hijacker", struct {
+			testFlusher
+			testHijacker
+			http.ResponseWriter
+		}{testFlusher{}, testHijacker{}, &basicWriter{}}, true, false, true},
+		{"reader-from-hijacker", struct {
+			testReaderFrom
+			testHijacker
+			http.ResponseWriter
+		}{testReaderFrom{}, testHijacker{}, &basicWriter{}}, false, true, true},
+		{"all", testAllInterfaces{basicWriter: &basicWriter{}}, true, true, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, wrapped := newResponseRecorder(test.rw)
+
+			if _, ok := wrapped.(http.Flusher); ok != test.flusher {
+				t.Errorf("wrong http.Flusher, want %v, got %v", test.flusher, ok)
+			}
+
+			if _, ok := wrapped.(io.ReaderFrom); ok != test.readerFrom {
+				t.Errorf("wrong io.ReaderFrom, want %v, got %v", test.readerFrom, ok)
+			}
+
+			if _, ok := wrapped.(http.Hijacker); ok != test.hijacker {
+				t.Errorf("wrong http.Hijacker, want %v, got %v", test.hijacker, ok)
+			}
+		})
+	}
+}
+
+func TestResponseRecorder(t *testing.T) {
+	var tests = []struct {
+		name    string
+		rw      func(*basicWriter) http.ResponseWriter
+		handler func(http.ResponseWriter)
+		status  int
+		bytes   int64
+	}{
+		{
+			name:    "nothing",
+			handler: func(rw http.ResponseWriter) {},
+			status:  http.StatusOK,
+		},
+		{
+			name: "no-write-header",
+			handler: func(rw http.ResponseWriter) {
+				_, _ = rw.Write([]byte("hello"))
+				_, _ = rw.Write([]byte(" world"))
+			},
+			status: http.StatusOK,
+			bytes:  11,
+		},
+		{
+			name: "write-header",
+			handler: func(rw http.ResponseWriter) {
+				rw.WriteHeader(http.StatusNotFound)
+				_, _ = rw.Write([]byte("not found\n"))
+			},
+			status: http.StatusNotFound,
+			bytes:  10,
+		},
+		{
+			name: "write-header-twice",
+			handler: func(rw http.ResponseWriter) {
+				rw.WriteHeader(http.StatusPartialContent)
+				rw.WriteHeader(http.StatusInternalServerError)
+			},
+			status: http.StatusPartialContent,
+		},
+		{
+			name: "write-header-after-write",
+			handler: func(rw http.ResponseWriter) {
+				_, _ = rw.Write([]byte("x"))
+				rw.WriteHeader(http.StatusInternalServerError)
+			},
+			status: http.StatusOK,
+			bytes:  1,
+		},
+		{
+			name: "flush",
+			rw:   func(w *basicWriter) http.ResponseWriter { return testFlusher{w} },
+			handler: func(rw http.ResponseWriter) {
+				rw.(http.Flusher).Flush()
+				rw.WriteHeader(http.StatusNotFound)
+			},
+			status: http.StatusOK,
+		},
+		{
+			name: "read-from",
+			rw:   func(w *basicWriter) http.ResponseWriter { return testReaderFrom{w} },
+			handler: func(rw http.ResponseWriter) {
+				_, _ = io.Copy(rw, strings.NewReader("hello world\n"))
+			},
+			status: http.StatusOK,
+			bytes:  12,
+		},
+		{
+			name: "copy",
+			handler: func(rw http.ResponseWriter) {
+				rw.WriteHeader(http.StatusGone)
+				_, _ = io.Copy(rw, strings.NewReader("hello world\n"))
+			},
+			status: http.StatusGone,
+			bytes:  12,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := &basicWriter{}
+			var rw http.ResponseWriter = w
+			if test.rw != nil {
+				rw = test.rw(w)
+			}
+
+			rec, wrapped := newResponseRecorder(rw)
+			test.handler(wrapped)
+
+			if rec.Status() != test.status {
+				t.Errorf("wrong status, want %v, got %v", test.status, rec.Status())
+			}
+
+			if rec.Bytes() != test.bytes {
+				t.Errorf("wrong number of bytes, want %v, got %v", test.bytes, rec.Bytes())
+			}
+
+			if int64(w.buf.Len()) != test.bytes {
+				t.Errorf("wrong number of bytes written to the ResponseWriter, want %v, got %v", test.bytes, w.buf.Len())
+			}
+		})
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// environment variables used to pass the listeners to the new process during
+// a graceful restart
+const (
+	listenFDsEnv = "DISTRIPROXY_LISTEN_FDS"
+	readyFDEnv   = "DISTRIPROXY_READY_FD"
+)
+
+// restartTimeout is the time the new process has to take over the listeners.
+const restartTimeout = 30 * time.Second
+
+// inheritedListeners returns the listeners passed in by the previous process
+// during a graceful restart, or nil if the process was started normally. The
+// listeners are passed as the file descriptors 3 and following, like systemd
+// does it.
+func inheritedListeners() ([]net.Listener, error) {
+	s := os.Getenv(listenFDsEnv)
+	if s == "" {
+		return nil, nil
+	}
+	_ = os.Unsetenv(listenFDsEnv)
+
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %v: %v", listenFDsEnv, err)
+	}
+
+	var listeners []net.Listener
+	for i := 0; i < n; i++ {
+		f := os.NewFile(uintptr(3+i), fmt.Sprintf("listener-%d", i))
+		listener, err := net.FileListener(f)
+		_ = f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("inherited listener %d: %v", i, err)
+		}
+		listeners = append(listeners, listener)
+	}
+
+	return listeners, nil
+}
+
+// sameAddress reports whether the listener l accepts connections on the
+// configured address (see parseListenAddress). Host names are resolved, an
+// empty host matches the unspecified address.
+func sameAddress(l net.Listener, address string) bool {
+	network, addr := parseListenAddress(address)
+	if l.Addr().Network() != network {
+		return false
+	}
+
+	if network == "unix" {
+		return l.Addr().String() == addr
+	}
+
+	want, err := net.ResolveTCPAddr(network, addr)
+	if err != nil {
+		return false
+	}
+
+	have, ok := l.Addr().(*net.TCPAddr)
+	if !ok || have.Port != want.Port {
+		return false
+	}
+
+	if want.IP == nil || want.IP.IsUnspecified() {
+		return have.IP == nil || have.IP.IsUnspecified()
+	}
+
+	return want.IP.Equal(have.IP)
+}
+
+// takeListener removes the listener for address from inherited and returns
+// it, or nil if there is none.
+func takeListener(inherited *[]net.Listener, address string) net.Listener {
+	for i, l := range *inherited {
+		if sameAddress(l, address) {
+			*inherited = append((*inherited)[:i], (*inherited)[i+1:]...)
+			return l
+		}
+	}
+
+	return nil
+}
+
+// takeOverListeners returns a listener for each address, using the matching
+// listener inherited from the previous process if there is one. New sockets
+// are opened for addresses added to the config since, see listenOn. The
+// inherited listeners which have been used are removed from inherited.
+func takeOverListeners(inherited *[]net.Listener, addresses []string, socketMode os.FileMode) ([]net.Listener, []bool, error) {
+	var listeners []net.Listener
+	var taken []bool
+	for _, address := range addresses {
+		if l := takeListener(inherited, address); l != nil {
+			listeners = append(listeners, l)
+			taken = append(taken, true)
+			continue
+		}
+
+		l, err := listenOn(address, socketMode)
+		if err != nil {
+			for _, l := range listeners {
+				_ = l.Close()
+			}
+			return nil, nil, fmt.Errorf("unable to bind to %v: %v", address, err)
+		}
+		listeners = append(listeners, l)
+		taken = append(taken, false)
+	}
+
+	return listeners, taken, nil
+}
+
+// notifyReady tells the previous process that the listeners have been taken
+// over, so that it can shut down.
+func notifyReady() {
+	s := os.Getenv(readyFDEnv)
+	if s == "" {
+		return
+	}
+	_ = os.Unsetenv(readyFDEnv)
+
+	fd, err := strconv.Atoi(s)
+	if err != nil {
+		log.Printf("invalid %v: %v", readyFDEnv, err)
+		return
+	}
+
+	f := os.NewFile(uintptr(fd), "ready")
+	_, err = f.Write([]byte{1})
+	if err != nil {
+		log.Printf("notifying previous process failed: %v", err)
+	}
+	_ = f.Close()
+}
+
+// restartOnSignal starts a new process with the same arguments when SIGUSR2
+// is received and passes the listeners on to it. When the new process is
+// ready, the returned channel is closed and the current process should shut
+// down gracefully. If starting the new process fails, the current process
+// keeps running.
+func restartOnSignal(listeners []net.Listener) <-chan struct{} {
+	restart := make(chan struct{})
+
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR2)
+
+	go func() {
+		for range ch {
+			log.Printf("received SIGUSR2, starting new process")
+
+			err := startSuccessor(listeners)
+			if err != nil {
+				log.Printf("graceful restart failed: %v", err)
+				continue
+			}
+
+			signal.Stop(ch)
+			close(restart)
+			return
+		}
+	}()
+
+	return restart
+}
+
+// startSuccessor starts a new process and waits until it has taken over the
+// listeners.
+func startSuccessor(listeners []net.Listener) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	return startProcess(exe, os.Args[1:], listeners)
+}
+
+// startProcess runs exe with args, passes the listeners on and waits until
+// the new process has taken them over.
+func startProcess(exe string, args []string, listeners []net.Listener) error {
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			_ = f.Close()
+		}
+	}()
+
+	for _, listener := range listeners {
+		l, ok := listener.(interface {
+			File() (*os.File, error)
+		})
+		if !ok {
+			return fmt.Errorf("listener %v cannot be passed on", listener.Addr())
+		}
+
+		f, err := l.File()
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+	}
+
+	rd, wr, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = rd.Close()
+	}()
+	files = append(files, wr)
+
+	cmd := exec.Command(exe, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("%v=%d", listenFDsEnv, len(listeners)),
+		fmt.Sprintf("%v=%d", readyFDEnv, 3+len(listeners)),
+	)
+
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+
+	// close the write end here, so that reading returns an error if the new
+	// process exits without reporting that it is ready
+	_ = wr.Close()
+
+	ready := make(chan error, 1)
+	go func() {
+		_, err := rd.Read(make([]byte, 1))
+		ready <- err
+	}()
+
+	select {
+	case err := <-ready:
+		if err != nil {
+			_ = cmd.Wait()
+			return errors.New("new process exited before taking over the listeners")
+		}
+	case <-time.After(restartTimeout):
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return errors.New("timeout waiting for the new process")
+	}
+
+	log.Printf("new process %d took over the listeners", cmd.Process.Pid)
+
+	// the socket file of a Unix listener is in use by the new process, do
+	// not remove it when shutting down
+	for _, listener := range listeners {
+		if l, ok := listener.(*net.UnixListener); ok {
+			l.SetUnlinkOnClose(false)
+		}
+	}
+
+	return cmd.Process.Release()
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func listen(t *testing.T, network, address string) net.Listener {
+	t.Helper()
+
+	l, err := net.Listen(network, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return l
+}
+
+func port(l net.Listener) string {
+	return strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+}
+
+func TestSameAddress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "distriproxy-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	local := listen(t, "tcp", "127.0.0.1:0")
+	defer local.Close()
+
+	wildcard := listen(t, "tcp", ":0")
+	defer wildcard.Close()
+
+	socket := filepath.Join(dir, "distriproxy.sock")
+	unix := listen(t, "unix", socket)
+	defer unix.Close()
+
+	var tests = []struct {
+		listener net.Listener
+		address  string
+		same     bool
+	}{
+		{local, "127.0.0.1:" + port(local), true},
+		{local, "tcp:127.0.0.1:" + port(local), true},
+		{local, ":" + port(local), false},
+		{local, "127.0.0.2:" + port(local), false},
+		{local, "127.0.0.1:" + port(wildcard), false},
+		{local, "unix:" + socket, false},
+		{local, "invalid", false},
+		{wildcard, ":" + port(wildcard), true},
+		{wildcard, "0.0.0.0:" + port(wildcard), true},
+		{wildcard, "[::]:" + port(wildcard), true},
+		{wildcard, "127.0.0.1:" + port(wildcard), false},
+		{unix, "unix:" + socket, true},
+		{unix, "unix:" + socket + "2", false},
+		{unix, socket, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.address, func(t *testing.T) {
+			if sameAddress(test.listener, test.address) != test.same {
+				t.Fatalf("wrong result for %v and %v, want %v", test.listener.Addr(), test.address, test.same)
+			}
+		})
+	}
+}
+
+func TestTakeOverListeners(t *testing.T) {
+	public := listen(t, "tcp", "127.0.0.1:0")
+	defer public.Close()
+
+	admin := listen(t, "tcp", "127.0.0.1:0")
+	defer admin.Close()
+
+	old := listen(t, "tcp", "127.0.0.1:0")
+	defer old.Close()
+
+	publicAddress := "127.0.0.1:" + port(public)
+	adminAddress := "127.0.0.1:" + port(admin)
+
+	// the order has changed, the old listener was removed from the config
+	// and a new one was added
+	inherited := []net.Listener{admin, old, public}
+	listeners, taken, err := takeOverListeners(&inherited, []string{publicAddress, "127.0.0.1:0"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		_ = listeners[1].Close()
+	}()
+
+	if len(listeners) != 2 || listeners[0] != public {
+		t.Fatalf("wrong listeners returned: %v", listeners)
+	}
+
+	if !taken[0] || taken[1] {
+		t.Fatalf("wrong listeners reported as taken over: %v", taken)
+	}
+
+	if listeners[1] == admin || listeners[1] == old {
+		t.Fatalf("inherited listener %v used for a new address", listeners[1].Addr())
+	}
+
+	if l := takeListener(&inherited, adminAddress); l != admin {
+		t.Fatalf("wrong admin listener returned: %v", l)
+	}
+
+	if len(inherited) != 1 || inherited[0] != old {
+		t.Fatalf("wrong listeners remaining: %v", inherited)
+	}
+
+	if l := takeListener(&inherited, adminAddress); l != nil {
+		t.Fatalf("listener %v returned twice", l.Addr())
+	}
+}
+
+// restartHelperEnv is set for the process started by TestRestart.
+const restartHelperEnv = "DISTRIPROXY_TEST_RESTART_HELPER"
+
+// TestRestartHelper is run as the new process by TestRestart. It takes over
+// the listener, reports that it is ready and answers one connection.
+func TestRestartHelper(t *testing.T) {
+	address := os.Getenv(restartHelperEnv)
+	if address == "" {
+		t.Skip("only run as the new process by TestRestart")
+	}
+
+	inherited, err := inheritedListeners()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener := takeListener(&inherited, address)
+	if listener == nil {
+		t.Fatalf("listener for %v not passed in, got %v", address, inherited)
+	}
+	defer listener.Close()
+
+	notifyReady()
+
+	go func() {
+		time.Sleep(10 * time.Second)
+		_ = listener.Close()
+	}()
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fmt.Fprintf(conn, "new process %d\n", os.Getpid())
+	_ = conn.Close()
+}
+
+func TestRestart(t *testing.T) {
+	listener := listen(t, "tcp", "127.0.0.1:0")
+	address := listener.Addr().String()
+
+	err := os.Setenv(restartHelperEnv, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.Unsetenv(restartHelperEnv)
+	}()
+
+	err = startProcess(os.Args[0], []string{"-test.run=^TestRestartHelper$"}, []net.Listener{listener})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the previous process stops accepting connections
+	_ = listener.Close()
+
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "new process "
+	if len(line) < len(want) || line[:len(want)] != want || line == fmt.Sprintf("new process %d\n", os.Getpid()) {
+		t.Fatalf("connection not answered by the new process: %q", line)
+	}
+}
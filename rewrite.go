@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// rewriteRule replaces all matches of a regular expression in the request
+// path.
+type rewriteRule struct {
+	match   *regexp.Regexp
+	replace string
+}
+
+// compileRewrites compiles the rewrite blocks of a path.
+func compileRewrites(rewrites []Rewrite) ([]rewriteRule, error) {
+	rules := make([]rewriteRule, 0, len(rewrites))
+	for _, rw := range rewrites {
+		re, err := regexp.Compile(rw.Match)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rewrite match %q: %v", rw.Match, err)
+		}
+
+		rules = append(rules, rewriteRule{match: re, replace: rw.Replace})
+	}
+	return rules, nil
+}
+
+// applyRewrites applies the rules in order to the path p, each rule works on
+// the result of the previous one. Rules which do not match leave the path
+// unchanged.
+func applyRewrites(rules []rewriteRule, p string) string {
+	for _, rule := range rules {
+		p = rule.match.ReplaceAllString(p, rule.replace)
+	}
+	return p
+}
+
+// normalizePrefix returns the prefix p as an absolute path without a trailing
+// slash, or the empty string if p is empty or "/".
+func normalizePrefix(p string) string {
+	if p == "" {
+		return ""
+	}
+	return strings.TrimRight(cleanPath(p), "/")
+}
+
+// replacePrefix removes the prefix strip from the path p (if p is below it)
+// and then prepends add. Both prefixes must be normalized.
+func replacePrefix(p, strip, add string) string {
+	if strip != "" {
+		switch {
+		case p == strip:
+			p = "/"
+		case strings.HasPrefix(p, strip+"/"):
+			p = strings.TrimPrefix(p, strip)
+		}
+	}
+
+	return add + p
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCompileRewrites(t *testing.T) {
+	rules, err := compileRewrites(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rules) != 0 {
+		t.Fatalf("unexpected rules %v", rules)
+	}
+
+	_, err = compileRewrites([]Rewrite{
+		{Match: "^/pool/", Replace: "/"},
+		{Match: "^/dists/(", Replace: "/"},
+	})
+	if err == nil || !strings.Contains(err.Error(), `"^/dists/("`) {
+		t.Fatalf("invalid regexp not rejected, error %v", err)
+	}
+}
+
+func TestApplyRewrites(t *testing.T) {
+	var tests = []struct {
+		name     string
+		rewrites []Rewrite
+		path     string
+		want     string
+	}{
+		{
+			name: "none",
+			path: "/pool/main/x.deb",
+			want: "/pool/main/x.deb",
+		},
+		{
+			name:     "no-match",
+			rewrites: []Rewrite{{Match: "^/ubuntu/", Replace: "/"}},
+			path:     "/pool/main/x.deb",
+			want:     "/pool/main/x.deb",
+		},
+		{
+			name:     "match",
+			rewrites: []Rewrite{{Match: "^/ubuntu/", Replace: "/"}},
+			path:     "/ubuntu/pool/main/x.deb",
+			want:     "/pool/main/x.deb",
+		},
+		{
+			name:     "anchored",
+			rewrites: []Rewrite{{Match: "^/ubuntu/", Replace: "/"}},
+			path:     "/mirror/ubuntu/pool/x.deb",
+			want:     "/mirror/ubuntu/pool/x.deb",
+		},
+		{
+			name:     "all-matches",
+			rewrites: []Rewrite{{Match: "-", Replace: "_"}},
+			path:     "/pool/a-b/c-d.deb",
+			want:     "/pool/a_b/c_d.deb",
+		},
+		{
+			name:     "capture-group",
+			rewrites: []Rewrite{{Match: `^/releases/(\d+)/(.*)$`, Replace: "/pub/fedora/linux/releases/$1/Everything/$2"}},
+			path:     "/releases/30/x86_64/os/repodata/repomd.xml",
+			want:     "/pub/fedora/linux/releases/30/Everything/x86_64/os/repodata/repomd.xml",
+		},
+		{
+			name:     "named-group",
+			rewrites: []Rewrite{{Match: `^/(?P<dist>[a-z]+)-updates/`, Replace: "/dists/${dist}/updates/"}},
+			path:     "/buster-updates/Release",
+			want:     "/dists/buster/updates/Release",
+		},
+		{
+			// $1x refers to the group named "1x", which does not exist
+			name:     "group-followed-by-text",
+			rewrites: []Rewrite{{Match: `^/v(\d)/`, Replace: "/$1x/"}},
+			path:     "/v2/file",
+			want:     "//file",
+		},
+		{
+			name:     "group-braces",
+			rewrites: []Rewrite{{Match: `^/v(\d)/`, Replace: "/${1}x/"}},
+			path:     "/v2/file",
+			want:     "/2x/file",
+		},
+		{
+			name:     "literal-dollar",
+			rewrites: []Rewrite{{Match: `^/price/`, Replace: "/$$/"}},
+			path:     "/price/x",
+			want:     "/$/x",
+		},
+		{
+			name: "order",
+			rewrites: []Rewrite{
+				{Match: "^/a/", Replace: "/b/"},
+				{Match: "^/b/", Replace: "/c/"},
+			},
+			path: "/a/x",
+			want: "/c/x",
+		},
+		{
+			name: "order-reversed",
+			rewrites: []Rewrite{
+				{Match: "^/b/", Replace: "/c/"},
+				{Match: "^/a/", Replace: "/b/"},
+			},
+			path: "/a/x",
+			want: "/b/x",
+		},
+		{
+			name: "second-only",
+			rewrites: []Rewrite{
+				{Match: "^/ubuntu/", Replace: "/"},
+				{Match: `\.deb$`, Replace: ".udeb"},
+			},
+			path: "/pool/x.deb",
+			want: "/pool/x.udeb",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rules, err := compileRewrites(test.rewrites)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := applyRewrites(rules, test.path)
+			if got != test.want {
+				t.Fatalf("wrong path, want %q, got %q", test.want, got)
+			}
+		})
+	}
+}
+
+func TestProxyRewrite(t *testing.T) {
+	upstream := echoRequest()
+	defer upstream.Close()
+
+	cfg := Path{
+		Path: "/fedora",
+		URL:  upstream.URL + "/pub/fedora/linux",
+		Rewrites: []Rewrite{
+			{Match: `^/releases/(\d+)/`, Replace: "/releases/$1/Everything/"},
+			// the result of a rewrite is cleaned
+			{Match: `^/old/`, Replace: "//archive/./"},
+		},
+	}
+
+	srv := newTestProxy(t, cfg)
+	defer srv.Close()
+
+	var tests = []struct {
+		path string
+		want string
+	}{
+		{"/fedora/releases/30/x86_64/os/repodata/repomd.xml", "/pub/fedora/linux/releases/30/Everything/x86_64/os/repodata/repomd.xml"},
+		{"/fedora/updates/30/repodata/repomd.xml", "/pub/fedora/linux/updates/30/repodata/repomd.xml"},
+		{"/fedora/old/x.rpm", "/pub/fedora/linux/archive/x.rpm"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			res, body := get(t, srv.URL+test.path)
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("unexpected status %v", res.Status)
+			}
+
+			if !strings.HasPrefix(body, "GET "+test.want+" ") {
+				t.Fatalf("wrong upstream request, want path %q, got %q", test.want, body)
+			}
+		})
+	}
+}
+
+func TestNormalizePrefix(t *testing.T) {
+	var tests = []struct {
+		prefix string
+		want   string
+	}{
+		{"", ""},
+		{"/", ""},
+		{"//", ""},
+		{"/ubuntu", "/ubuntu"},
+		{"/ubuntu/", "/ubuntu"},
+		{"ubuntu/", "/ubuntu"},
+		{"/mirror//ubuntu/./", "/mirror/ubuntu"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.prefix, func(t *testing.T) {
+			got := normalizePrefix(test.prefix)
+			if got != test.want {
+				t.Fatalf("wrong prefix, want %q, got %q", test.want, got)
+			}
+		})
+	}
+}
+
+func TestReplacePrefix(t *testing.T) {
+	var tests = []struct {
+		name  string
+		path  string
+		strip string
+		add   string
+		want  string
+	}{
+		{"none", "/dists/buster/Release", "", "", "/dists/buster/Release"},
+		{"strip", "/ubuntu/dists/bionic/Release", "/ubuntu", "", "/dists/bionic/Release"},
+		{"strip-trailing-slash", "/ubuntu/", "/ubuntu", "", "/"},
+		{"strip-empty-remainder", "/ubuntu", "/ubuntu", "", "/"},
+		{"strip-no-match", "/debian/dists/buster/Release", "/ubuntu", "", "/debian/dists/buster/Release"},
+		{"strip-partial-segment", "/ubuntu-ports/dists/Release", "/ubuntu", "", "/ubuntu-ports/dists/Release"},
+		{"strip-not-at-start", "/mirror/ubuntu/x", "/ubuntu", "", "/mirror/ubuntu/x"},
+		{"add", "/dists/buster/Release", "", "/debian", "/debian/dists/buster/Release"},
+		{"add-root", "/", "", "/debian", "/debian/"},
+		{"strip-add", "/ubuntu/dists/bionic/Release", "/ubuntu", "/ubuntu-ports", "/ubuntu-ports/dists/bionic/Release"},
+		{"strip-add-empty-remainder", "/ubuntu", "/ubuntu", "/ubuntu-ports", "/ubuntu-ports/"},
+		{"strip-add-no-match", "/debian/x", "/ubuntu", "/ubuntu-ports", "/ubuntu-ports/debian/x"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := replacePrefix(test.path, test.strip, test.add)
+			if got != test.want {
+				t.Fatalf("wrong path, want %q, got %q", test.want, got)
+			}
+		})
+	}
+}
+
+func TestProxyReplacePrefix(t *testing.T) {
+	upstream := echoRequest()
+	defer upstream.Close()
+
+	strip := "/ubuntu/"
+	add := "mirror/ubuntu-ports/"
+	cfg := Path{
+		Path:        "/ports",
+		URL:         upstream.URL,
+		StripPrefix: &strip,
+		AddPrefix:   &add,
+	}
+
+	srv := newTestProxy(t, cfg)
+	defer srv.Close()
+
+	var tests = []struct {
+		path string
+		want string
+	}{
+		{"/ports/ubuntu/dists/bionic/Release", "/mirror/ubuntu-ports/dists/bionic/Release"},
+		{"/ports/ubuntu/", "/mirror/ubuntu-ports/"},
+		{"/ports/ubuntu", "/mirror/ubuntu-ports/"},
+		{"/ports/ubuntux/Release", "/mirror/ubuntu-ports/ubuntux/Release"},
+		{"/ports/pool/x.deb", "/mirror/ubuntu-ports/pool/x.deb"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			res, body := get(t, srv.URL+test.path)
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("unexpected status %v", res.Status)
+			}
+
+			if !strings.HasPrefix(body, "GET "+test.want+" ") {
+				t.Fatalf("wrong upstream request, want path %q, got %q", test.want, body)
+			}
+		})
+	}
+}
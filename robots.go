@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+)
+
+// defaultRobotsTxt disallows crawling everything.
+const defaultRobotsTxt = "User-agent: *\nDisallow: /\n"
+
+// Robots answers requests for /robots.txt with body and rejects all other
+// requests whose User-Agent matches bots (if not nil) with 403. The remaining
+// requests are passed to next.
+func Robots(next http.Handler, body []byte, bots *regexp.Regexp, shared *Shared) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		// only handle requests for this server, not proxy requests
+		if req.URL.Host == "" && req.URL.Path == "/robots.txt" &&
+			(req.Method == http.MethodGet || req.Method == http.MethodHead) {
+
+			setServer(rw.Header())
+			rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			rw.Header().Set("Content-Length", strconv.Itoa(len(body)))
+			rw.WriteHeader(http.StatusOK)
+			if req.Method == http.MethodGet {
+				_, _ = rw.Write(body)
+			}
+			return
+		}
+
+		// reject bots, but only after they had the chance to read robots.txt
+		if bots != nil && bots.MatchString(req.UserAgent()) {
+			shared.writeError(rw, req, "", errForbidden("%v reject request for %v from bot %q", clientIP(req), req.URL.Path, req.UserAgent()))
+			return
+		}
+
+		next.ServeHTTP(rw, req)
+	})
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// routeRewrite is the JSON representation of a rewrite rule.
+type routeRewrite struct {
+	Match   string `json:"match"`
+	Replace string `json:"replace"`
+}
+
+// route is the JSON representation of a configured path with the effective
+// settings, the global defaults are applied.
+type route struct {
+	Path            string           `json:"path"`
+	Upstream        string           `json:"upstream"`
+	VerifyByHash    bool             `json:"verify_by_hash"`
+	GPGKeyring      string           `json:"gpg_keyring,omitempty"`
+	UpstreamTimeout string           `json:"upstream_timeout,omitempty"`
+	UpstreamCAFile  string           `json:"upstream_ca_file,omitempty"`
+	UpstreamProxy   string           `json:"upstream_proxy,omitempty"`
+	ForwardQuery    bool             `json:"forward_query"`
+	MaxParallel     int              `json:"max_parallel,omitempty"`
+	RequireAuth     bool             `json:"require_auth"`
+	Log             bool             `json:"log"`
+	ResponseHeaders *ResponseHeaders `json:"response_headers,omitempty"`
+	Rewrites        []routeRewrite   `json:"rewrites"`
+	StripPrefix     string           `json:"strip_prefix,omitempty"`
+	AddPrefix       string           `json:"add_prefix,omitempty"`
+}
+
+// Routes serves the configured paths as JSON.
+type Routes struct {
+	routes []route
+}
+
+// NewRoutes returns the routes for the paths in cfg.
+func NewRoutes(cfg Config) *Routes {
+	r := &Routes{routes: []route{}}
+
+	for _, path := range cfg.Paths {
+		rt := route{
+			Path:            path.Path,
+			Upstream:        path.URL,
+			VerifyByHash:    path.VerifyByHash != nil && *path.VerifyByHash,
+			GPGKeyring:      stringValue(path.GPGKeyring),
+			UpstreamTimeout: stringValue(path.UpstreamTimeout, cfg.UpstreamTimeout),
+			UpstreamCAFile:  stringValue(path.UpstreamCAFile, cfg.UpstreamCAFile),
+			UpstreamProxy:   stringValue(path.UpstreamProxy, cfg.UpstreamProxy),
+			ForwardQuery:    path.ForwardQuery != nil && *path.ForwardQuery,
+			RequireAuth:     cfg.Auth != nil && (path.RequireAuth == nil || *path.RequireAuth),
+			Log:             path.Log == nil || *path.Log,
+			ResponseHeaders: path.ResponseHeaders,
+			Rewrites:        []routeRewrite{},
+			StripPrefix:     normalizePrefix(stringValue(path.StripPrefix)),
+			AddPrefix:       normalizePrefix(stringValue(path.AddPrefix)),
+		}
+
+		if path.MaxParallel != nil {
+			rt.MaxParallel = *path.MaxParallel
+		}
+
+		for _, rewrite := range path.Rewrites {
+			rt.Rewrites = append(rt.Rewrites, routeRewrite{Match: rewrite.Match, Replace: rewrite.Replace})
+		}
+
+		r.routes = append(r.routes, rt)
+	}
+
+	return r
+}
+
+func (r *Routes) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	setServer(rw.Header())
+	rw.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(rw).Encode(r.routes)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context/ctxhttp"
+)
+
+// verifyTimeout bounds the time spent checking all upstreams at startup.
+const verifyTimeout = 30 * time.Second
+
+// upstreamCheck is an upstream to verify at startup, the result is stored in
+// status and err.
+type upstreamCheck struct {
+	path   Path
+	client *http.Client
+
+	status string
+	err    error
+}
+
+// verifyUpstreams checks all upstreams concurrently, it returns when all
+// checks are done or verifyTimeout has passed.
+func verifyUpstreams(checks []upstreamCheck, userAgent string) {
+	ctx, cancel := context.WithTimeout(context.Background(), verifyTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for i := range checks {
+		wg.Add(1)
+		go func(c *upstreamCheck) {
+			defer wg.Done()
+			c.status, c.err = verifyUpstream(ctx, c.path, c.client, userAgent)
+		}(&checks[i])
+	}
+	wg.Wait()
+}
+
+// verifyUpstream checks that the upstream for path is reachable by sending a
+// HEAD request for the root URL. Any HTTP response below 500 is accepted,
+// since many mirrors do not allow listing their root directory. For file://
+// URLs, the directory must exist.
+func verifyUpstream(ctx context.Context, path Path, client *http.Client, userAgent string) (string, error) {
+	if strings.HasPrefix(path.URL, "file://") {
+		dir := strings.TrimPrefix(path.URL, "file://")
+		fi, err := os.Stat(dir)
+		if err != nil {
+			return "", err
+		}
+
+		if !fi.IsDir() {
+			return "", fmt.Errorf("%v is not a directory", dir)
+		}
+
+		return "directory exists", nil
+	}
+
+	req, err := http.NewRequest(http.MethodHead, strings.TrimRight(path.URL, "/")+"/", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("User-Agent", userAgent)
+
+	if path.UpstreamAuth != nil {
+		authorization, err := upstreamAuthorization(*path.UpstreamAuth)
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Authorization", authorization)
+	}
+
+	res, err := ctxhttp.Do(ctx, client, req)
+	if err != nil {
+		return "", err
+	}
+	_ = res.Body.Close()
+
+	if res.StatusCode >= 500 {
+		return "", fmt.Errorf("server error: %v", res.Status)
+	}
+
+	return res.Status, nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestVerifyUpstream(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodHead {
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		if req.Header.Get("User-Agent") != "distriproxy-test" {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		switch {
+		case strings.HasPrefix(req.URL.Path, "/private/"):
+			if req.Header.Get("Authorization") != "Bearer secret" {
+				rw.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+		case req.URL.Path == "/forbidden/":
+			rw.WriteHeader(http.StatusForbidden)
+			return
+		case req.URL.Path == "/broken/":
+			rw.WriteHeader(http.StatusBadGateway)
+			return
+		case req.URL.Path != "/debian/":
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+	}))
+	defer upstream.Close()
+
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	file := filepath.Join(dir, "file")
+	err := ioutil.WriteFile(file, []byte("x"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token := "secret"
+	auth := &UpstreamAuth{Scheme: "bearer", Credentials: &token}
+
+	var tests = []struct {
+		name   string
+		path   Path
+		status string
+		err    string
+	}{
+		{"ok", Path{URL: upstream.URL + "/debian"}, "200 OK", ""},
+		{"trailing-slash", Path{URL: upstream.URL + "/debian/"}, "200 OK", ""},
+		{"forbidden", Path{URL: upstream.URL + "/forbidden"}, "403 Forbidden", ""},
+		{"not-found", Path{URL: upstream.URL + "/ubuntu"}, "404 Not Found", ""},
+		{"auth", Path{URL: upstream.URL + "/private", UpstreamAuth: auth}, "200 OK", ""},
+		{"auth-missing", Path{URL: upstream.URL + "/private"}, "401 Unauthorized", ""},
+		{"server-error", Path{URL: upstream.URL + "/broken"}, "", "server error: 502 Bad Gateway"},
+		{"unreachable", Path{URL: closed.URL}, "", "connection refused"},
+		{"dir", Path{URL: "file://" + dir}, "directory exists", ""},
+		{"file", Path{URL: "file://" + file}, "", "is not a directory"},
+		{"dir-missing", Path{URL: "file://" + filepath.Join(dir, "missing")}, "", "no such file or directory"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			status, err := verifyUpstream(context.Background(), test.path, http.DefaultClient, "distriproxy-test")
+
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("wrong error, want %q, got %v", test.err, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if status != test.status {
+				t.Fatalf("wrong status, want %q, got %q", test.status, status)
+			}
+		})
+	}
+}
+
+func TestVerifyUpstreams(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/broken/" {
+			rw.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer upstream.Close()
+
+	checks := []upstreamCheck{
+		{path: Path{Path: "/debian", URL: upstream.URL + "/debian"}, client: http.DefaultClient},
+		{path: Path{Path: "/broken", URL: upstream.URL + "/broken"}, client: http.DefaultClient},
+		{path: Path{Path: "/ubuntu", URL: upstream.URL + "/ubuntu"}, client: http.DefaultClient},
+	}
+
+	verifyUpstreams(checks, "distriproxy-test")
+
+	for i, c := range checks {
+		if i == 1 {
+			if c.err == nil {
+				t.Errorf("check %v did not fail", c.path.Path)
+			}
+			continue
+		}
+
+		if c.err != nil || c.status != "200 OK" {
+			t.Errorf("unexpected result for %v: %q, %v", c.path.Path, c.status, c.err)
+		}
+	}
+}
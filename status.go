@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// pathStats counts the requests handled for a path. The counters are updated
+// atomically.
+type pathStats struct {
+	requests int64
+	inFlight int64
+	errors   int64
+	bytes    int64
+
+	path     string
+	upstream string
+}
+
+// Status collects live statistics for all configured paths and serves them
+// as JSON.
+type Status struct {
+	m     sync.Mutex
+	paths []*pathStats
+}
+
+// register returns the statistics for a new path.
+func (s *Status) register(path, upstream string) *pathStats {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	stats := &pathStats{path: path, upstream: upstream}
+	s.paths = append(s.paths, stats)
+	return stats
+}
+
+// pathStatus is the JSON representation of the statistics for a path.
+type pathStatus struct {
+	Path     string `json:"path"`
+	Upstream string `json:"upstream"`
+	Requests int64  `json:"requests"`
+	InFlight int64  `json:"in_flight"`
+	Errors   int64  `json:"errors"`
+	Bytes    int64  `json:"bytes"`
+}
+
+// statusDocument is returned by the status endpoint.
+type statusDocument struct {
+	Version string       `json:"version"`
+	Paths   []pathStatus `json:"paths"`
+}
+
+func (s *Status) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	doc := statusDocument{
+		Version: version,
+		Paths:   []pathStatus{},
+	}
+
+	s.m.Lock()
+	for _, stats := range s.paths {
+		doc.Paths = append(doc.Paths, pathStatus{
+			Path:     stats.path,
+			Upstream: stats.upstream,
+			Requests: atomic.LoadInt64(&stats.requests),
+			InFlight: atomic.LoadInt64(&stats.inFlight),
+			Errors:   atomic.LoadInt64(&stats.errors),
+			Bytes:    atomic.LoadInt64(&stats.bytes),
+		})
+	}
+	s.m.Unlock()
+
+	setServer(rw.Header())
+	rw.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(rw).Encode(doc)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// getStatus requests the status document from url and returns it, decoded
+// once into a generic map and once into statusDocument.
+func getStatus(t *testing.T, url string) (map[string]interface{}, statusDocument) {
+	t.Helper()
+
+	res, body := get(t, url)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %v", res.Status)
+	}
+
+	if res.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("wrong Content-Type %q", res.Header.Get("Content-Type"))
+	}
+
+	var raw map[string]interface{}
+	err := json.Unmarshal([]byte(body), &raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var doc statusDocument
+	err = json.Unmarshal([]byte(body), &doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return raw, doc
+}
+
+func keys(m map[string]interface{}) []string {
+	var list []string
+	for k := range m {
+		list = append(list, k)
+	}
+	sort.Strings(list)
+	return list
+}
+
+func TestStatus(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/error":
+			rw.WriteHeader(http.StatusServiceUnavailable)
+		case "/missing":
+			http.NotFound(rw, req)
+		case "/slow":
+			<-release
+		default:
+			fmt.Fprint(rw, "hello\n")
+		}
+	}))
+	defer upstream.Close()
+
+	shared := &Shared{LogLevel: LogError, Status: &Status{}}
+
+	mux := http.NewServeMux()
+	for _, path := range []string{"/debian", "/ubuntu"} {
+		proxy, err := NewProxy(Path{Path: path, URL: upstream.URL + "/"}, nil, shared)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mux.Handle(path+"/", proxy)
+	}
+	mux.Handle("/status", shared.Status)
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	raw, doc := getStatus(t, srv.URL+"/status")
+	if !reflect.DeepEqual(keys(raw), []string{"paths", "version"}) {
+		t.Fatalf("wrong fields in status document: %v", keys(raw))
+	}
+
+	if doc.Version != version {
+		t.Errorf("wrong version %q", doc.Version)
+	}
+
+	for _, path := range []string{"/x", "/y", "/missing", "/error"} {
+		_, _ = get(t, srv.URL+"/debian"+path)
+	}
+
+	// keep a request in flight
+	done := make(chan struct{})
+	go func() {
+		res, err := http.Get(srv.URL + "/ubuntu/slow")
+		if err == nil {
+			_ = res.Body.Close()
+		}
+		close(done)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		raw, doc = getStatus(t, srv.URL+"/status")
+		if len(doc.Paths) == 2 && doc.Paths[1].InFlight == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("request is not in flight: %+v", doc)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	close(release)
+	<-done
+
+	paths := raw["paths"].([]interface{})
+	fields := keys(paths[0].(map[string]interface{}))
+	want := []string{"bytes", "errors", "in_flight", "path", "requests", "upstream"}
+	if !reflect.DeepEqual(fields, want) {
+		t.Fatalf("wrong fields for path, want %v, got %v", want, fields)
+	}
+
+	wantPaths := []pathStatus{
+		// the 404 is not an error, the body of the 503 is empty
+		{Path: "/debian", Upstream: upstream.URL, Requests: 4, Errors: 1, Bytes: 2*6 + int64(len("404 page not found\n"))},
+		{Path: "/ubuntu", Upstream: upstream.URL, Requests: 1, InFlight: 1},
+	}
+	if !reflect.DeepEqual(doc.Paths, wantPaths) {
+		t.Fatalf("wrong statistics\nwant: %+v\n got: %+v", wantPaths, doc.Paths)
+	}
+
+	_, doc = getStatus(t, srv.URL+"/status")
+	if doc.Paths[1].InFlight != 0 {
+		t.Fatalf("request still in flight: %+v", doc.Paths[1])
+	}
+}
+
+func TestStatusEmpty(t *testing.T) {
+	srv := httptest.NewServer(&Status{})
+	defer srv.Close()
+
+	res, body := get(t, srv.URL)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %v", res.Status)
+	}
+
+	want := fmt.Sprintf(`{"version":%q,"paths":[]}`+"\n", version)
+	if body != want {
+		t.Fatalf("wrong body, want %q, got %q", want, body)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// loadCredentials returns the credentials configured in exactly one of the
+// fields of cfg, surrounding whitespace (e.g. a trailing newline in a file) is
+// removed.
+func loadCredentials(cfg UpstreamAuth) (string, error) {
+	n := 0
+	for _, v := range []*string{cfg.Credentials, cfg.CredentialsFile, cfg.CredentialsEnv} {
+		if v != nil {
+			n++
+		}
+	}
+
+	if n != 1 {
+		return "", errors.New("exactly one of credentials, credentials_file and credentials_env must be set")
+	}
+
+	var s string
+	switch {
+	case cfg.Credentials != nil:
+		s = *cfg.Credentials
+	case cfg.CredentialsFile != nil:
+		buf, err := ioutil.ReadFile(*cfg.CredentialsFile)
+		if err != nil {
+			return "", err
+		}
+		s = string(buf)
+	case cfg.CredentialsEnv != nil:
+		v, ok := os.LookupEnv(*cfg.CredentialsEnv)
+		if !ok {
+			return "", fmt.Errorf("environment variable %v is not set", *cfg.CredentialsEnv)
+		}
+		s = v
+	}
+
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return "", errors.New("credentials are empty")
+	}
+
+	return s, nil
+}
+
+// upstreamAuthorization returns the value of the Authorization header sent to
+// the upstream server.
+func upstreamAuthorization(cfg UpstreamAuth) (string, error) {
+	credentials, err := loadCredentials(cfg)
+	if err != nil {
+		return "", fmt.Errorf("upstream_auth: %v", err)
+	}
+
+	switch cfg.Scheme {
+	case "basic":
+		if !strings.Contains(credentials, ":") {
+			return "", errors.New("upstream_auth: invalid credentials, expected name:password")
+		}
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(credentials)), nil
+	case "bearer":
+		return "Bearer " + credentials, nil
+	}
+
+	return "", fmt.Errorf("upstream_auth: unknown scheme %q", cfg.Scheme)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestUpstreamAuthorization(t *testing.T) {
+	credentials := "alice:secret"
+	token := "  secret-token\n"
+	invalid := "alice"
+
+	var tests = []struct {
+		name string
+		cfg  UpstreamAuth
+		want string
+	}{
+		{"basic", UpstreamAuth{Scheme: "basic", Credentials: &credentials}, "Basic YWxpY2U6c2VjcmV0"},
+		{"bearer", UpstreamAuth{Scheme: "bearer", Credentials: &token}, "Bearer secret-token"},
+		{"basic-invalid", UpstreamAuth{Scheme: "basic", Credentials: &invalid}, ""},
+		{"unknown-scheme", UpstreamAuth{Scheme: "digest", Credentials: &credentials}, ""},
+		{"no-credentials", UpstreamAuth{Scheme: "basic"}, ""},
+		{"two-sources", UpstreamAuth{Scheme: "basic", Credentials: &credentials, CredentialsEnv: &credentials}, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := upstreamAuthorization(test.cfg)
+			if test.want == "" {
+				if err == nil {
+					t.Fatalf("expected error not found, got %q", got)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got != test.want {
+				t.Fatalf("wrong header, want %q, got %q", test.want, got)
+			}
+		})
+	}
+}
+
+func TestProxyUpstreamAuth(t *testing.T) {
+	const token = "secret-upstream-token"
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer "+token {
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprintf(rw, "ok")
+	}))
+	defer upstream.Close()
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	credentials := token
+	cfg := Path{
+		Path:         "/private",
+		URL:          upstream.URL,
+		UpstreamAuth: &UpstreamAuth{Scheme: "bearer", Credentials: &credentials},
+	}
+
+	srv := newTestProxyShared(t, cfg, &Shared{LogLevel: LogDebug, LogSampleRate: 1})
+	defer srv.Close()
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/private/x.deb", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the client's credentials are replaced
+	req.Header.Set("Authorization", "Bearer client-token")
+
+	res, body := do(t, http.DefaultClient, req)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("wrong status, want %v, got %v", http.StatusOK, res.StatusCode)
+	}
+
+	if strings.Contains(body, token) {
+		t.Errorf("credentials found in response body %q", body)
+	}
+
+	for name, values := range res.Header {
+		for _, value := range values {
+			if strings.Contains(value, token) {
+				t.Errorf("credentials found in response header %v: %v", name, value)
+			}
+		}
+	}
+
+	if !strings.Contains(buf.String(), "Authorization: Bearer [redacted]") {
+		t.Errorf("upstream request header not logged:\n%s", buf.String())
+	}
+
+	if strings.Contains(buf.String(), token) {
+		t.Errorf("credentials found in log:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// version information, set at build time via -ldflags, see the Makefile
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
+// productName returns the name and version used in the Server and Via headers.
+func productName() string {
+	return "distriproxy/" + version
+}
+
+// serverHeader is sent in the Server header of all responses, replacing the
+// header of the upstream server. The header is omitted if it is empty.
+var serverHeader = productName()
+
+// setServer sets the Server header in header to serverHeader.
+func setServer(header http.Header) {
+	if serverHeader == "" {
+		header.Del("Server")
+		return
+	}
+	header.Set("Server", serverHeader)
+}
+
+// versionInfo is returned by the /version endpoint.
+type versionInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+}
+
+// serveVersion returns the build information as JSON.
+func serveVersion(rw http.ResponseWriter, req *http.Request) {
+	setServer(rw.Header())
+	rw.Header().Set("Content-Type", "application/json")
+
+	_ = json.NewEncoder(rw).Encode(versionInfo{
+		Version:   version,
+		Commit:    commit,
+		BuildDate: buildDate,
+	})
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestSetServer(t *testing.T) {
+	defer func(old string) { serverHeader = old }(serverHeader)
+
+	var tests = []struct {
+		server string
+		header []string
+		want   []string
+	}{
+		{"distriproxy/1.0", nil, []string{"distriproxy/1.0"}},
+		{"distriproxy/1.0", []string{"nginx"}, []string{"distriproxy/1.0"}},
+		{"distriproxy/1.0", []string{"nginx", "Apache"}, []string{"distriproxy/1.0"}},
+		{"", []string{"nginx"}, nil},
+		{"", nil, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%q/%q", test.server, test.header), func(t *testing.T) {
+			serverHeader = test.server
+
+			header := http.Header{}
+			if test.header != nil {
+				header["Server"] = append([]string{}, test.header...)
+			}
+
+			setServer(header)
+
+			if !reflect.DeepEqual(header["Server"], test.want) {
+				t.Fatalf("wrong Server header, want %q, got %q", test.want, header["Server"])
+			}
+		})
+	}
+}
+
+func TestProxyServerHeader(t *testing.T) {
+	defer func(old string) { serverHeader = old }(serverHeader)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Server", "nginx")
+		fmt.Fprint(rw, "hello\n")
+	}))
+	defer upstream.Close()
+
+	// an upstream server which is not reachable produces an error response
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+
+	var tests = []struct {
+		name     string
+		server   string
+		upstream string
+		status   int
+		want     []string
+	}{
+		{"default", productName(), upstream.URL, http.StatusOK, []string{productName()}},
+		{"custom", "proxy", upstream.URL, http.StatusOK, []string{"proxy"}},
+		{"omitted", "", upstream.URL, http.StatusOK, nil},
+		{"error", "proxy", unreachable.URL, http.StatusBadGateway, []string{"proxy"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			serverHeader = test.server
+
+			shared := &Shared{LogLevel: LogError}
+			srv := newTestProxyShared(t, Path{Path: "/debian", URL: test.upstream}, shared)
+			defer srv.Close()
+
+			res, _ := get(t, srv.URL+"/debian/dists/buster/Release")
+			if res.StatusCode != test.status {
+				t.Fatalf("wrong status, want %v, got %v", test.status, res.Status)
+			}
+
+			if !reflect.DeepEqual(res.Header["Server"], test.want) {
+				t.Fatalf("wrong Server header, want %q, got %q", test.want, res.Header["Server"])
+			}
+		})
+	}
+}
+
+func TestServeVersion(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(serveVersion))
+	defer srv.Close()
+
+	res, body := get(t, srv.URL+"/version")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("wrong status, want %v, got %v", http.StatusOK, res.Status)
+	}
+
+	if res.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("wrong Content-Type, want %q, got %q", "application/json", res.Header.Get("Content-Type"))
+	}
+
+	var got map[string]string
+	err := json.Unmarshal([]byte(body), &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"version":    version,
+		"commit":     commit,
+		"build_date": buildDate,
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("wrong version info, want %v, got %v", want, got)
+	}
+}
+
+func TestProxyUserAgent(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(rw, "%q", req.Header["User-Agent"])
+	}))
+	defer upstream.Close()
+
+	var tests = []struct {
+		name      string
+		userAgent string
+		want      string
+	}{
+		{"default", productName(), fmt.Sprintf("%q", []string{productName()})},
+		{"custom", "mirror-bot/1.0 (admin@example.com)", `["mirror-bot/1.0 (admin@example.com)"]`},
+		{"empty", "", "[]"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			shared := &Shared{LogLevel: LogError, UserAgent: test.userAgent}
+			srv := newTestProxyShared(t, Path{Path: "/debian", URL: upstream.URL}, shared)
+			defer srv.Close()
+
+			req, err := http.NewRequest(http.MethodGet, srv.URL+"/debian/dists/buster/Release", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// the client's User-Agent is never passed on
+			req.Header.Set("User-Agent", "Debian APT-HTTP/1.3 (2.2.4)")
+
+			_, body := do(t, http.DefaultClient, req)
+			if body != test.want {
+				t.Fatalf("wrong User-Agent sent upstream, want %v, got %v", test.want, body)
+			}
+		})
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// defaultViaPseudonym returns the host name, which is used in the Via header
+// by default.
+func defaultViaPseudonym() string {
+	name, err := os.Hostname()
+	if err != nil || name == "" {
+		return "distriproxy"
+	}
+	return name
+}
+
+// viaValue returns the value for the Via header (RFC 7230, section 5.7.1)
+// for a message received with the protocol version major.minor, e.g.
+// "1.1 proxy.example.com (distriproxy/1.0)".
+func viaValue(major, minor int, pseudonym string) string {
+	version := fmt.Sprintf("%d.%d", major, minor)
+	if major >= 2 {
+		version = fmt.Sprintf("%d", major)
+	}
+
+	return fmt.Sprintf("%v %v (%v)", version, pseudonym, productName())
+}
+
+// addVia appends distriproxy to the Via header, after any proxies the
+// message has already passed through.
+func (s *Shared) addVia(header http.Header, major, minor int) {
+	if s.ViaPseudonym == "" {
+		return
+	}
+
+	header.Add("Via", viaValue(major, minor, s.ViaPseudonym))
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestViaValue(t *testing.T) {
+	var tests = []struct {
+		major, minor int
+		pseudonym    string
+		want         string
+	}{
+		{1, 1, "distriproxy", "1.1 distriproxy (" + productName() + ")"},
+		{1, 0, "distriproxy", "1.0 distriproxy (" + productName() + ")"},
+		{2, 0, "proxy.example.com", "2 proxy.example.com (" + productName() + ")"},
+		{3, 0, "proxy.example.com", "3 proxy.example.com (" + productName() + ")"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.want, func(t *testing.T) {
+			got := viaValue(test.major, test.minor, test.pseudonym)
+			if got != test.want {
+				t.Fatalf("wrong Via value, want %q, got %q", test.want, got)
+			}
+		})
+	}
+}
+
+func TestAddVia(t *testing.T) {
+	own := "1.1 distriproxy (" + productName() + ")"
+
+	var tests = []struct {
+		name      string
+		pseudonym string
+		header    []string
+		want      []string
+	}{
+		{"empty", "distriproxy", nil, []string{own}},
+		{"chain", "distriproxy", []string{"1.0 fred, 1.1 p.example.net"},
+			[]string{"1.0 fred, 1.1 p.example.net", own}},
+		{"chain-fields", "distriproxy", []string{"1.0 fred", "1.1 p.example.net"},
+			[]string{"1.0 fred", "1.1 p.example.net", own}},
+		{"disabled", "", []string{"1.0 fred"}, []string{"1.0 fred"}},
+		{"disabled-empty", "", nil, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			header := http.Header{}
+			if test.header != nil {
+				header["Via"] = append([]string{}, test.header...)
+			}
+
+			shared := &Shared{ViaPseudonym: test.pseudonym}
+			shared.addVia(header, 1, 1)
+
+			if !reflect.DeepEqual(header["Via"], test.want) {
+				t.Fatalf("wrong Via header, want %q, got %q", test.want, header["Via"])
+			}
+		})
+	}
+}
+
+func TestProxyVia(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Via", "1.1 cdn.example.net")
+		fmt.Fprintf(rw, "%q", req.Header["Via"])
+	}))
+	defer upstream.Close()
+
+	shared := &Shared{LogLevel: LogError, ViaPseudonym: "proxy.example.com"}
+	srv := newTestProxyShared(t, Path{Path: "/debian", URL: upstream.URL}, shared)
+	defer srv.Close()
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/debian/dists/buster/Release", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Via", "1.0 fred")
+
+	res, body := do(t, http.DefaultClient, req)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %v", res.Status)
+	}
+
+	// the request was received with HTTP/1.1 from the client
+	wantReq := fmt.Sprintf("%q", []string{"1.0 fred", "1.1 proxy.example.com (" + productName() + ")"})
+	if body != wantReq {
+		t.Errorf("wrong Via header in upstream request, want %v, got %v", wantReq, body)
+	}
+
+	wantRes := []string{"1.1 cdn.example.net", "1.1 proxy.example.com (" + productName() + ")"}
+	if !reflect.DeepEqual(res.Header["Via"], wantRes) {
+		t.Errorf("wrong Via header in response, want %q, got %q", wantRes, res.Header["Via"])
+	}
+}